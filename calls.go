@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+)
+
+// Instructions that write reg[r], and so jump when r is the PC.
+var writesRegister = map[string]bool{
+	"IN": true, "ADD": true, "SUB": true, "MUL": true, "DIV": true,
+	"LD": true, "LDA": true, "LDC": true, "CAS": true, "FAA": true,
+	"CORE": true, "RECV": true,
+}
+
+// Report whether an instruction can change the flow of control.
+func canJump(ti TinyInstruction) bool {
+	switch ti.iop {
+	case "JLT", "JLE", "JGE", "JGT", "JEQ", "JNE", "USER":
+		return true
+	}
+	return writesRegister[ti.iop] && ti.iargs[0] == PC_REG
+}
+
+// Fetch the instruction at a virtual address, if there is one.
+func (tm *TinyMachine) instructionAt(addr int32) (TinyInstruction, bool) {
+	pa, ok := tm.translate(addr, false)
+	if !ok || pa < 0 || pa >= tm.mem_size {
+		return TinyInstruction{}, false
+	}
+	return tm.fetch(pa)
+}
+
+// Report whether the instruction at addr is a call. TM has no call
+// instruction, so a call is a jump that follows an LDA saving the address
+// after the jump, such as
+//
+//	LDA 0,1(7)
+//	LDA 7,f(0)
+//
+// with nothing that can jump in between.
+func (tm *TinyMachine) isCallSite(addr int32) bool {
+	ti, ok := tm.instructionAt(addr)
+	if !ok || !canJump(ti) {
+		return false
+	}
+
+	for a := addr - 1; a >= 0; a-- {
+		prev, ok := tm.instructionAt(a)
+		if !ok || canJump(prev) {
+			return false
+		}
+		if prev.iop == "LDA" && prev.iargs[0] != PC_REG && prev.iargs[2] == PC_REG && a+1+prev.iargs[1] == addr+1 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Step one instruction, reporting whether the program can go on. It can't
+// once it stops, blocks or reaches a breakpoint.
+func (tm *TinyMachine) stepOn() bool {
+	tm.stepProgram()
+	return tm.cpustate == cpuOK && !tm.blocked && !tm.stopAtBreakpoint()
+}
+
+// Run until the current routine returns, which is a jump to just after a
+// call. Calls made along the way are followed to their own returns, so
+// that recursion is handled.
+func (tm *TinyMachine) finishRoutine() bool {
+	var returns []int32 // Where the calls made so far return to
+
+	for {
+		pc := tm.registers[PC_REG]
+		call := tm.isCallSite(pc)
+		if !tm.stepOn() {
+			return false
+		}
+
+		next := tm.registers[PC_REG]
+		switch {
+		case next == pc+1:
+		case call:
+			returns = append(returns, pc+1)
+		case len(returns) > 0:
+			if next == returns[len(returns)-1] {
+				returns = returns[:len(returns)-1]
+			}
+		case tm.isCallSite(next - 1):
+			return true
+		}
+	}
+}
+
+// Step one instruction, running a routine it calls through to its return.
+func handleNext(tm *TinyMachine, args []string) error {
+	pc := tm.registers[PC_REG]
+	call := tm.isCallSite(pc)
+	if tm.stepOn() && call && tm.registers[PC_REG] != pc+1 {
+		tm.finishRoutine()
+	}
+	return nil
+}
+
+func handleUntil(tm *TinyMachine, args []string) error {
+	if len(args) != 1 {
+		return errors.New("Usage: until addr")
+	}
+
+	addr, err := tm.argNumber(args, 0, "", 0)
+	if err != nil {
+		return err
+	} else if addr < 0 || addr >= tm.mem_size {
+		return errors.New("Invalid address.")
+	}
+
+	for tm.stepOn() && tm.registers[PC_REG] != addr {
+	}
+	return nil
+}
+
+func handleFinish(tm *TinyMachine, args []string) error {
+	if tm.finishRoutine() {
+		tm.speak("Returned to PC", tm.registers[PC_REG])
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// Doubles r1 after incrementing it, with each routine returning through
+// the register its caller saved the return address in.
+const callsProgram = `LDC 1,5(0)
+LDA 0,1(7)
+LDC 7,6(0)
+OUT 1,0,0
+HALT 0,0,0
+HALT 0,0,0
+LDA 2,1(7)
+LDC 7,10(0)
+ADD 1,1,1
+LDA 7,0(0)
+LDA 1,1(1)
+LDA 7,0(2)
+`
+
+func TestIsCallSite(t *testing.T) {
+	var tm TinyMachine
+	if err := tm.loadProgram("test", strings.NewReader(callsProgram)); err != nil {
+		t.Fatalf("Unexpected error loading program.")
+	}
+
+	for addr, want := range []bool{false, false, true, false, false, false, false, true, false, false, false, false} {
+		if got := tm.isCallSite(int32(addr)); got != want {
+			t.Errorf("%d: Expected call site %t. Got %t.", addr, want, got)
+		}
+	}
+}
+
+func TestStepCommands(t *testing.T) {
+	var tm TinyMachine
+	var out bytes.Buffer
+
+	if err := tm.loadProgram("test", strings.NewReader(callsProgram)); err != nil {
+		t.Fatalf("Unexpected error loading program.")
+	}
+	tm.stdout = &out
+	menu := tm.menu()
+
+	cases := []struct {
+		line string
+		pc   int32
+		r1   int32
+	}{
+		{"next", 1, 5},
+		{"next", 2, 5},
+		{"next", 3, 12},
+		{"c", 0, 0},
+		{"until 7", 7, 5},
+		{"finish", 3, 12},
+		{"c", 0, 0},
+		{"until 11", 11, 6},
+		{"finish", 8, 6},
+		{"next", 9, 12},
+		{"c", 0, 0},
+		{"b 10", 0, 0},
+		{"until 2", 2, 5},
+		{"next", 10, 5},
+		{"finish", 8, 6},
+	}
+	for i, c := range cases {
+		if err := tm.command(menu, c.line); err != nil {
+			t.Errorf("%d: Unexpected error from %q: %s", i, c.line, err)
+		}
+		if tm.registers[PC_REG] != c.pc || tm.registers[1] != c.r1 {
+			t.Errorf("%d: Expected PC %d and r1 %d after %q. Got %d and %d.",
+				i, c.pc, c.r1, c.line, tm.registers[PC_REG], tm.registers[1])
+		}
+	}
+	if !strings.Contains(out.String(), "Breakpoint at PC 10, hit 1 times.\n") || !strings.HasSuffix(out.String(), "Returned to PC 8\n") {
+		t.Errorf("Expected to stop at the breakpoint and report the return. Got %q.", out.String())
+	}
+
+	for i, c := range []struct{ line, want_err string }{
+		{"until", "Usage: until addr"},
+		{"until 1024", "Invalid address."},
+		{"until x", "Invalid number: 'x'"},
+	} {
+		err := tm.command(menu, c.line)
+		if err == nil || err.Error() != c.want_err {
+			t.Errorf("%d: Expected error %q. Got %v.", i, c.want_err, err)
+		}
+	}
+}
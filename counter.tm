@@ -0,0 +1,14 @@
+* Run with --cores=4 --sched_policy=random --time_slice=1. Every core adds
+* 1 to the shared counter at address 1 ten times with FAA, then outputs
+* the counter, so the last value output is always 40. Replacing the FAA
+* with "LD 4,1(0)", "ADD 4,4,3" and "ST 4,1(0)" loses updates whenever
+* the cores interleave.
+LDC  2,10(0)
+LDC  3,1(0)
+LDA  4,0(3)
+FAA  4,1(0)
+SUB  2,2,3
+JGT  2,-4(7)
+LD   5,1(0)
+OUT  5,0,0
+HALT 0,0,0
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// The number of instructions a crash report shows leading up to a fault.
+const CRASH_HISTORY = 16
+
+// An instruction executed, as it was when it ran.
+type executed struct {
+	pc          int32
+	instruction TinyInstruction
+}
+
+// Remember an instruction about to be executed, forgetting the oldest once
+// there are CRASH_HISTORY of them.
+func (tm *TinyMachine) noteExecuted(pc int32, ti TinyInstruction) {
+	if len(tm.recent) < CRASH_HISTORY {
+		tm.recent = append(tm.recent, executed{pc, ti})
+		return
+	}
+	tm.recent[tm.recentnext] = executed{pc, ti}
+	tm.recentnext = (tm.recentnext + 1) % CRASH_HISTORY
+}
+
+// The instructions executed most recently, oldest first.
+func (tm *TinyMachine) lastExecuted() []executed {
+	return append(append([]executed{}, tm.recent[tm.recentnext:]...), tm.recent[:tm.recentnext]...)
+}
+
+// Describe an instruction and where it came from in the program.
+func (tm *TinyMachine) describeInstruction(pc int32, ti TinyInstruction) string {
+	s := fmt.Sprintf("%04d: %v", pc, ti)
+	if pc >= 0 && int(pc) < len(tm.srclines) {
+		s += fmt.Sprintf("  (%s line %d)", tm.progname, tm.srclines[pc])
+	}
+	return s
+}
+
+// The data address or jump target computed by the instruction that
+// faulted. The registers haven't changed since, except for the PC.
+func (tm *TinyMachine) effectiveAddress(ti TinyInstruction) (int32, bool) {
+	base := func(r int32) int32 {
+		if r == PC_REG {
+			return tm.faultpc + 1
+		}
+		return tm.registers[r]
+	}
+
+	switch {
+	case ti.iop == "LDC":
+		return 0, false
+	case ti.iop == "CAS":
+		return base(ti.iargs[1]), true
+	case ti.ioptype == iopRM || ti.ioptype == iopRA:
+		return ti.iargs[1] + base(ti.iargs[2]), true
+	}
+	return 0, false
+}
+
+// Report a fault that stopped the machine, and write a core file if asked.
+func (tm *TinyMachine) crash() {
+	tm.crashReport()
+
+	if *core_file != "" {
+		name := tm.coreFileName()
+		if err := tm.writeCore(name); err != nil {
+			tm.speak("Error writing core file:", err)
+		} else {
+			tm.speak("Core written to", name)
+		}
+	}
+}
+
+// The name of the core file for this machine. Machines that run alongside
+// others, as processes of a Scheduler or HTTP API sessions, each get their
+// own, named after the -core flag with the process or session added.
+func (tm *TinyMachine) coreFileName() string {
+	switch {
+	case tm.session != "":
+		return *core_file + "." + tm.session
+	case tm.sched != nil:
+		return fmt.Sprintf("%s.%d", *core_file, tm.coreid)
+	}
+	return *core_file
+}
+
+func (tm *TinyMachine) crashReport() {
+	tm.speak("Crash report:", tm.cpustate)
+
+	if ti, ok := tm.instructionAt(tm.faultpc); ok {
+		tm.speak("Faulting instruction:", tm.describeInstruction(tm.faultpc, ti))
+		if ea, ok := tm.effectiveAddress(ti); ok {
+			tm.speak("Effective address:", ea)
+		}
+	} else {
+		tm.speak(fmt.Sprintf("Faulting instruction: %04d: not a valid instruction", tm.faultpc))
+	}
+
+	tm.dumpRegisters()
+
+	recent := tm.lastExecuted()
+	tm.speak(fmt.Sprintf("Last %d instructions executed:", len(recent)))
+	for _, e := range recent {
+		tm.speak("  " + tm.describeInstruction(e.pc, e.instruction))
+	}
+}
+
+// A core file saves the state of a machine that faulted, as JSON, so that
+// it can be looked at later with tinyvm inspect.
+type coreFile struct {
+	Program      string          `json:"program"`
+	Unified      bool            `json:"unified"`
+	State        TinyCPUState    `json:"state"`
+	FaultPC      int32           `json:"fault_pc"`
+	FaultAddr    int32           `json:"fault_addr"`
+	Steps        int             `json:"steps"`
+	Registers    [NUM_REGS]int32 `json:"registers"`
+	Recent       []coreStep      `json:"recent"`
+	Instructions []string        `json:"instructions,omitempty"`
+	SourceLines  []int           `json:"source_lines"`
+	UserMode     bool            `json:"user_mode"`
+	Paging       bool            `json:"paging"`
+	PageTable    int32           `json:"page_table"`
+	PageTableLen int32           `json:"page_table_len"`
+	Protected    []coreRegion    `json:"protected,omitempty"`
+	Memory       []int32         `json:"memory"`
+}
+
+type coreRegion struct {
+	Start int32         `json:"start"`
+	End   int32         `json:"end"`
+	Prot  MemProtection `json:"prot"`
+}
+
+type coreStep struct {
+	PC          int32  `json:"pc"`
+	Instruction string `json:"instruction"`
+}
+
+func (tm *TinyMachine) writeCore(name string) error {
+	core := coreFile{
+		Program:     tm.progname,
+		Unified:     tm.unified,
+		State:       tm.cpustate,
+		FaultPC:     tm.faultpc,
+		FaultAddr:   tm.faultaddr,
+		Steps:       tm.steps,
+		Registers:   tm.registers,
+		SourceLines: tm.srclines,
+		Memory:      tm.data_memory,
+	}
+	core.UserMode, core.Paging = tm.usermode, tm.paging
+	core.PageTable, core.PageTableLen = tm.ptbase, tm.ptlen
+	for _, r := range tm.protected {
+		core.Protected = append(core.Protected, coreRegion{r.start, r.end, r.prot})
+	}
+	for _, e := range tm.lastExecuted() {
+		core.Recent = append(core.Recent, coreStep{e.pc, e.instruction.String()})
+	}
+	if !tm.unified {
+		// Leave out the HALTs filling memory after the program.
+		n := len(tm.instruction_memory)
+		for n > 0 && tm.instruction_memory[n-1].String() == "HALT 0,0,0" {
+			n--
+		}
+		for _, ti := range tm.instruction_memory[:n] {
+			core.Instructions = append(core.Instructions, ti.String())
+		}
+	}
+
+	b, err := json.MarshalIndent(core, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(name, b, 0644)
+}
+
+// Load the machine saved in a core file.
+func (tm *TinyMachine) loadCore(name string) error {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return err
+	}
+
+	var core coreFile
+	if err := json.Unmarshal(b, &core); err != nil {
+		return fmt.Errorf("Invalid core file %s: %s", name, err)
+	} else if len(core.Memory) == 0 || len(core.Instructions) > len(core.Memory) {
+		return fmt.Errorf("Invalid core file %s: wrong memory size", name)
+	}
+
+	// The memory is sized to fit the core, rather than by -mem_size.
+	tm.coresize = int32(len(core.Memory))
+	tm.unified = core.Unified
+	tm.initializeMachine(true)
+
+	for i, text := range core.Instructions {
+		if tm.instruction_memory[i], err = parseInstruction(text); err != nil {
+			return fmt.Errorf("Invalid core file %s: %s", name, err)
+		}
+	}
+	for _, step := range core.Recent {
+		ti, err := parseInstruction(step.Instruction)
+		if err != nil {
+			return fmt.Errorf("Invalid core file %s: %s", name, err)
+		}
+		tm.noteExecuted(step.PC, ti)
+	}
+
+	copy(tm.data_memory, core.Memory)
+	tm.progname, tm.srclines = core.Program, core.SourceLines
+	tm.registers, tm.steps = core.Registers, core.Steps
+	tm.cpustate, tm.faultpc, tm.faultaddr = core.State, core.FaultPC, core.FaultAddr
+
+	// Addresses are translated, and checked, as they were when it crashed.
+	tm.usermode, tm.paging = core.UserMode, core.Paging
+	tm.ptbase, tm.ptlen = core.PageTable, core.PageTableLen
+	for _, r := range core.Protected {
+		tm.protected = append(tm.protected, protRegion{r.Start, r.End, r.Prot})
+	}
+	return nil
+}
+
+// Show the crash report from a core file, then let its state be looked at
+// with the usual commands.
+func inspectCore(name string) error {
+	var tm TinyMachine
+	if err := tm.loadCore(name); err != nil {
+		return err
+	}
+
+	tm.speak("Inspecting core file", name, "from", tm.progname)
+	tm.crashReport()
+	tm.Interact()
+	return nil
+}
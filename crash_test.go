@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCrashReport(t *testing.T) {
+	core := filepath.Join(t.TempDir(), "test.core")
+	*core_file = core
+	defer func() { *core_file = "" }()
+
+	var tm TinyMachine
+	var out bytes.Buffer
+
+	// Counts r1 down from 20, then loads from far beyond memory.
+	prog := "* Crash\nLDC 1,20(0)\nLDC 2,1(0)\n\nSUB 1,1,2\nJGT 1,-2(7)\nLD 3,2000(1)\nHALT 0,0,0\n"
+	if err := tm.loadProgram("crash.tm", strings.NewReader(prog)); err != nil {
+		t.Fatalf("Unexpected error loading program.")
+	}
+	tm.stdout = &out
+	tm.runProgram()
+
+	report, _, _ := strings.Cut(out.String(), "Core written to")
+	for _, want := range []string{
+		"Data memory access violation. Program halted.\nCrash report: data memory access violation\n",
+		"Faulting instruction: 0004: LD   3,2000(1)  (crash.tm line 7)\nEffective address: 2000\n",
+		"Current Tiny Machine register values:\n",
+		"Last 16 instructions executed:\n  0003: JGT  1,-2(7)  (crash.tm line 6)\n  0002: SUB  1,1,2  (crash.tm line 5)\n",
+		"  0003: JGT  1,-2(7)  (crash.tm line 6)\n  0004: LD   3,2000(1)  (crash.tm line 7)\n",
+	} {
+		if !strings.Contains(report, want) {
+			t.Errorf("Expected %q in the crash report. Got %q.", want, report)
+		}
+	}
+	if !strings.HasSuffix(out.String(), "Core written to "+core+"\n") {
+		t.Errorf("Expected the core file to be written. Got %q.", out.String())
+	}
+
+	// The core file holds everything needed to show the report again.
+	var loaded TinyMachine
+	var loadedout bytes.Buffer
+	loaded.stdout = &loadedout
+	if err := loaded.loadCore(core); err != nil {
+		t.Fatalf("Unexpected error loading core: %s", err)
+	}
+	if loaded.registers != tm.registers || loaded.cpustate != cpuDMEM_ERR || !reflect.DeepEqual(loaded.data_memory, tm.data_memory) {
+		t.Errorf("Expected the machine to be restored. Got registers %v in state %d.", loaded.registers, loaded.cpustate)
+	}
+	loaded.crashReport()
+	if _, after, _ := strings.Cut(report, "Program halted.\n"); loadedout.String() != after {
+		t.Errorf("Expected the same crash report from the core. Got %q.", loadedout.String())
+	}
+}
+
+func TestLoadCoreErrors(t *testing.T) {
+	dir := t.TempDir()
+	cases := []struct {
+		core     string
+		want_err string
+	}{
+		{`{"memory": [`, "Invalid core file %s: unexpected end of JSON input"},
+		{`{"memory": []}`, "Invalid core file %s: wrong memory size"},
+		{`{"memory": [0], "instructions": ["JMP 1"]}`, "Invalid core file %s: Invalid opcode: 'JMP'"},
+	}
+
+	for i, c := range cases {
+		var tm TinyMachine
+		tm.stdout = &bytes.Buffer{}
+
+		name := filepath.Join(dir, "bad.core")
+		if err := os.WriteFile(name, []byte(c.core), 0644); err != nil {
+			t.Fatal(err)
+		}
+		err := tm.loadCore(name)
+		if want := strings.Replace(c.want_err, "%s", name, 1); err == nil || err.Error() != want {
+			t.Errorf("%d: Expected error %q. Got %v.", i, want, err)
+		}
+	}
+}
+
+func TestCorePagedUserMode(t *testing.T) {
+	core := filepath.Join(t.TempDir(), "test.core")
+	*core_file = core
+	defer func() { *core_file = "" }()
+
+	// Maps page 0 to itself, then loads from the unmapped page 1 in user
+	// mode.
+	prog := ".protect 100 110 ro\nLDC 1,3(0)\nST 1,200(0)\nLDC 2,1(0)\nPTB 2,200(0)\nUSER 0,5(0)\nLD 3,20(0)\n"
+
+	var tm TinyMachine
+	var out bytes.Buffer
+	if err := tm.loadProgram("paged.tm", strings.NewReader(prog)); err != nil {
+		t.Fatalf("Unexpected error loading program: %s", err)
+	}
+	tm.stdout = &out
+	tm.runProgram()
+	if tm.cpustate != cpuPAGE_FAULT || !tm.usermode {
+		t.Fatalf("Expected a page fault in user mode. Got state %d.", tm.cpustate)
+	}
+
+	var loaded TinyMachine
+	loaded.stdout = &bytes.Buffer{}
+	if err := loaded.loadCore(core); err != nil {
+		t.Fatalf("Unexpected error loading core: %s", err)
+	}
+	if !loaded.usermode || !loaded.paging || loaded.ptbase != 200 || loaded.ptlen != 1 ||
+		!reflect.DeepEqual(loaded.protected, tm.protected) {
+		t.Errorf("Expected the mode, paging and protection to be restored. Got user mode %t, paging %t at %d with %d entries, protection %v.",
+			loaded.usermode, loaded.paging, loaded.ptbase, loaded.ptlen, loaded.protected)
+	}
+	if _, ok := loaded.translate(20, false); ok {
+		t.Errorf("Expected address 20 to be unmapped in the loaded core.")
+	}
+}
+
+func TestEffectiveAddress(t *testing.T) {
+	var tm TinyMachine
+	tm.initializeMachine(true)
+	tm.registers[2] = 10
+
+	cases := []struct {
+		ti   TinyInstruction
+		addr int32
+		ok   bool
+	}{
+		{TinyInstruction{"LD", []int32{1, 5, 2}, iopRM}, 15, true},
+		{TinyInstruction{"LDA", []int32{1, 5, 2}, iopRA}, 15, true},
+		{TinyInstruction{"LDC", []int32{1, 5, 2}, iopRA}, 0, false},
+		{TinyInstruction{"ADD", []int32{1, 2, 2}, iopRO}, 0, false},
+	}
+	for i, c := range cases {
+		if addr, ok := tm.effectiveAddress(c.ti); addr != c.addr || ok != c.ok {
+			t.Errorf("%d: Expected %d, %t. Got %d, %t.", i, c.addr, c.ok, addr, ok)
+		}
+	}
+}
+
+func TestCoreFileName(t *testing.T) {
+	*core_file = "test.core"
+	defer func() { *core_file = "" }()
+
+	cases := []struct {
+		tm   TinyMachine
+		want string
+	}{
+		{TinyMachine{}, "test.core"},
+		{TinyMachine{sched: &Scheduler{}, coreid: 2}, "test.core.2"},
+		{TinyMachine{session: "7"}, "test.core.7"},
+	}
+	for i, c := range cases {
+		if got := c.tm.coreFileName(); got != c.want {
+			t.Errorf("%d: Expected %q. Got %q.", i, c.want, got)
+		}
+	}
+}
@@ -0,0 +1,453 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Read a message framed by a Content-Length header, as used by the debug
+// adapter and language server protocols.
+func readFramed(r *bufio.Reader) ([]byte, error) {
+	length := -1
+
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+
+		line = strings.TrimSpace(line)
+		if line == "" {
+			break
+		}
+		if v, ok := strings.CutPrefix(line, "Content-Length:"); ok {
+			length, err = strconv.Atoi(strings.TrimSpace(v))
+			if err != nil {
+				return nil, errors.New("Invalid Content-Length: '" + v + "'")
+			}
+		}
+	}
+
+	if length < 0 {
+		return nil, errors.New("Message has no Content-Length")
+	}
+
+	body := make([]byte, length)
+	_, err := io.ReadFull(r, body)
+	return body, err
+}
+
+// Write v as JSON, framed by a Content-Length header.
+func writeFramed(w io.Writer, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(w, "Content-Length: %d\r\n\r\n%s", len(body), body)
+	return err
+}
+
+// The fields common to every debug adapter protocol message.
+type dapMessage struct {
+	Seq        int             `json:"seq"`
+	Type       string          `json:"type"`
+	Command    string          `json:"command,omitempty"`
+	Arguments  json.RawMessage `json:"arguments,omitempty"`
+	RequestSeq int             `json:"request_seq,omitempty"`
+	Success    bool            `json:"success,omitempty"`
+	Message    string          `json:"message,omitempty"`
+	Event      string          `json:"event,omitempty"`
+	Body       interface{}     `json:"body,omitempty"`
+}
+
+// Variable references for the scopes of the only stack frame.
+const (
+	dapRegisters  = 1
+	dapDataMemory = 2
+)
+
+// A dapSession debugs one program for an editor speaking the debug
+// adapter protocol. Each source line holds one instruction, so stepping
+// is by instruction. While the program runs, lines typed in the debug
+// console are queued as input for IN.
+type dapSession struct {
+	tm          *TinyMachine
+	conn        io.Writer
+	program     string
+	stoponentry bool
+	console     chan string // Debug console lines waiting to be read by IN
+	input       string      // The rest of the console line being read
+	mu          sync.Mutex  // Guards the fields below, and writes to conn
+	seq         int
+	running     bool
+	paused      bool
+}
+
+// Serve a debugging session on addr, or on stdin and stdout if addr is -.
+func serveDAP(addr string) error {
+	if addr == "-" {
+		return newDAPSession(os.Stdout).serve(os.Stdin)
+	}
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Waiting for debugger connection on", ln.Addr())
+	conn, err := ln.Accept()
+	ln.Close()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	return newDAPSession(conn).serve(conn)
+}
+
+func newDAPSession(conn io.Writer) *dapSession {
+	return &dapSession{conn: conn, console: make(chan string, 64)}
+}
+
+// Handle requests until the editor disconnects.
+func (d *dapSession) serve(r io.Reader) error {
+	reader := bufio.NewReader(r)
+
+	for {
+		body, err := readFramed(reader)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		var req dapMessage
+		if err := json.Unmarshal(body, &req); err != nil {
+			return err
+		}
+		if req.Type != "request" {
+			continue
+		}
+
+		result, err := d.handle(req)
+		resp := dapMessage{Type: "response", RequestSeq: req.Seq, Command: req.Command, Success: err == nil, Body: result}
+		if err != nil {
+			resp.Message = err.Error()
+		}
+		d.send(resp)
+
+		// Anything that runs the program waits until it has been replied
+		// to, so that the stopped event comes after the response.
+		switch req.Command {
+		case "initialize":
+			d.event("initialized", nil)
+		case "configurationDone":
+			if d.tm == nil {
+				break
+			} else if d.stoponentry {
+				d.event("stopped", map[string]interface{}{"reason": "entry", "threadId": 1})
+			} else {
+				d.resume(false)
+			}
+		case "continue", "next", "stepIn":
+			if err == nil {
+				d.resume(req.Command != "continue")
+			}
+		case "disconnect", "terminate":
+			return nil
+		}
+	}
+}
+
+func (d *dapSession) send(msg dapMessage) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.seq++
+	msg.Seq = d.seq
+	writeFramed(d.conn, msg)
+}
+
+func (d *dapSession) event(name string, body interface{}) {
+	d.send(dapMessage{Type: "event", Event: name, Body: body})
+}
+
+// Output from the machine is shown in the debug console.
+func (d *dapSession) Write(p []byte) (int, error) {
+	d.event("output", map[string]interface{}{"category": "stdout", "output": string(p)})
+	return len(p), nil
+}
+
+// Input for IN is read from lines typed in the debug console.
+func (d *dapSession) Read(p []byte) (int, error) {
+	if d.input == "" {
+		d.input = <-d.console
+	}
+
+	n := copy(p, d.input)
+	d.input = d.input[n:]
+	return n, nil
+}
+
+func (d *dapSession) handle(req dapMessage) (interface{}, error) {
+	var args struct {
+		Program     string `json:"program"`
+		StopOnEntry bool   `json:"stopOnEntry"`
+		Source      struct {
+			Path string `json:"path"`
+		} `json:"source"`
+		Breakpoints []struct {
+			Line      int    `json:"line"`
+			Condition string `json:"condition"`
+		} `json:"breakpoints"`
+		VariablesReference int    `json:"variablesReference"`
+		Start              int32  `json:"start"`
+		Count              int32  `json:"count"`
+		Expression         string `json:"expression"`
+		Context            string `json:"context"`
+	}
+	if len(req.Arguments) > 0 {
+		if err := json.Unmarshal(req.Arguments, &args); err != nil {
+			return nil, err
+		}
+	}
+
+	switch req.Command {
+	case "initialize":
+		return map[string]interface{}{
+			"supportsConfigurationDoneRequest": true,
+			"supportsConditionalBreakpoints":   true,
+		}, nil
+	case "launch":
+		return nil, d.launch(args.Program, args.StopOnEntry)
+	case "configurationDone", "disconnect", "terminate":
+		return nil, nil
+	case "evaluate":
+		if args.Context != "repl" {
+			return nil, errors.New("Only input for IN can be entered in the debug console.")
+		}
+		d.console <- args.Expression + "\n"
+		return map[string]interface{}{"result": "", "variablesReference": 0}, nil
+	case "pause":
+		d.mu.Lock()
+		d.paused = true
+		d.mu.Unlock()
+		return nil, nil
+	}
+
+	if d.tm == nil {
+		return nil, errors.New("No program has been launched.")
+	}
+	d.mu.Lock()
+	running := d.running
+	d.mu.Unlock()
+
+	switch req.Command {
+	case "setBreakpoints":
+		lines, conds := make([]int, len(args.Breakpoints)), make([]string, len(args.Breakpoints))
+		for i, bp := range args.Breakpoints {
+			lines[i], conds[i] = bp.Line, bp.Condition
+		}
+		return map[string]interface{}{"breakpoints": d.setBreakpoints(lines, conds)}, nil
+	case "threads":
+		return map[string]interface{}{"threads": []map[string]interface{}{{"id": 1, "name": d.program}}}, nil
+	}
+
+	if running {
+		return nil, errors.New("The program is running.")
+	}
+
+	switch req.Command {
+	case "continue":
+		return map[string]interface{}{"allThreadsContinued": true}, nil
+	case "next", "stepIn":
+		return nil, nil
+	case "stackTrace":
+		return d.stackTrace(), nil
+	case "scopes":
+		return map[string]interface{}{"scopes": []map[string]interface{}{
+			{"name": "Registers", "variablesReference": dapRegisters, "expensive": false},
+			{"name": "Data Memory", "variablesReference": dapDataMemory, "indexedVariables": d.tm.mem_size, "expensive": true},
+		}}, nil
+	case "variables":
+		return map[string]interface{}{"variables": d.variables(args.VariablesReference, args.Start, args.Count)}, nil
+	}
+
+	return nil, errors.New("Unsupported request: " + req.Command)
+}
+
+func (d *dapSession) launch(program string, stoponentry bool) error {
+	fh, err := os.Open(program)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+
+	tm := &TinyMachine{
+		unified: *unified,
+		stdin:   bufio.NewReader(d),
+		stdout:  d,
+	}
+	if err := tm.loadProgram(program, fh); err != nil {
+		return err
+	}
+
+	d.tm, d.program, d.stoponentry = tm, program, stoponentry
+	return nil
+}
+
+// Replace the breakpoints with ones at the given source lines, with their
+// conditions if not empty. A line without an instruction gets the
+// breakpoint of the next line that has one.
+func (d *dapSession) setBreakpoints(lines []int, conds []string) []map[string]interface{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.tm.breakpoints = nil
+	result := make([]map[string]interface{}, len(lines))
+	for i, line := range lines {
+		result[i] = map[string]interface{}{"verified": false, "line": line}
+
+		var cond *expr
+		if conds[i] != "" {
+			var err error
+			if cond, err = parseExpr(conds[i]); err != nil {
+				result[i]["message"] = err.Error()
+				continue
+			}
+		}
+
+		for addr, l := range d.tm.srclines {
+			if l >= line {
+				bp := d.tm.setBreakpoint(int32(addr))
+				bp.cond, bp.condsrc = cond, conds[i]
+				result[i] = map[string]interface{}{"verified": true, "line": l}
+				break
+			}
+		}
+	}
+
+	return result
+}
+
+// Execute one instruction, or run until a breakpoint, the program stops
+// or the editor pauses it, in the background.
+func (d *dapSession) resume(step bool) {
+	d.mu.Lock()
+	d.running, d.paused = true, false
+	d.mu.Unlock()
+
+	go func() {
+		tm := d.tm
+		reason := "step"
+
+		for tm.cpustate == cpuOK {
+			tm.stepProgram()
+			if step || tm.cpustate != cpuOK {
+				break
+			}
+
+			// The breakpoints can be replaced while running, so they're
+			// checked under the lock, but the output event takes it too.
+			d.mu.Lock()
+			breakpoint, err := tm.checkBreakpoint()
+			paused := d.paused
+			d.mu.Unlock()
+
+			if err != nil {
+				tm.speak("Error in breakpoint condition:", err)
+			}
+			if breakpoint {
+				reason = "breakpoint"
+				break
+			} else if paused || tm.blocked {
+				reason = "pause"
+				break
+			}
+		}
+
+		d.mu.Lock()
+		d.running = false
+		d.mu.Unlock()
+		d.stopped(reason)
+	}()
+}
+
+func (d *dapSession) stopped(reason string) {
+	switch d.tm.cpustate {
+	case cpuOK:
+		d.event("stopped", map[string]interface{}{"reason": reason, "threadId": 1, "allThreadsStopped": true})
+	case cpuHALTED:
+		d.event("exited", map[string]interface{}{"exitCode": 0})
+		d.event("terminated", nil)
+	default:
+		d.event("stopped", map[string]interface{}{
+			"reason":            "exception",
+			"description":       d.tm.cpustate.String(),
+			"threadId":          1,
+			"allThreadsStopped": true,
+		})
+	}
+}
+
+// The only stack frame is the instruction about to be executed, or the
+// one that faulted.
+func (d *dapSession) stackTrace() map[string]interface{} {
+	pc := d.tm.registers[PC_REG]
+	if d.tm.cpustate != cpuOK && d.tm.cpustate != cpuHALTED {
+		pc = d.tm.faultpc
+	}
+
+	frame := map[string]interface{}{
+		"id":     1,
+		"name":   fmt.Sprintf("PC %d", pc),
+		"line":   0,
+		"column": 0,
+		"source": map[string]interface{}{"path": d.program},
+	}
+	if pc >= 0 && int(pc) < len(d.tm.srclines) {
+		frame["line"], frame["column"] = d.tm.srclines[pc], 1
+		if instruction, ok := d.tm.fetch(pc); ok {
+			frame["name"] = fmt.Sprintf("%d: %v", pc, instruction)
+		}
+	}
+
+	return map[string]interface{}{"stackFrames": []interface{}{frame}, "totalFrames": 1}
+}
+
+func (d *dapSession) variables(ref int, start, count int32) []map[string]interface{} {
+	var vars []map[string]interface{}
+
+	switch ref {
+	case dapRegisters:
+		for i, v := range d.tm.registers {
+			name := fmt.Sprintf("r%d", i)
+			if i == PC_REG {
+				name = "pc"
+			}
+			vars = append(vars, map[string]interface{}{"name": name, "value": strconv.Itoa(int(v)), "variablesReference": 0})
+		}
+	case dapDataMemory:
+		if count <= 0 || start+count > d.tm.mem_size {
+			count = d.tm.mem_size - start
+		}
+		for i := start; i >= 0 && i < start+count; i++ {
+			vars = append(vars, map[string]interface{}{
+				"name":               fmt.Sprintf("[%d]", i),
+				"value":              strconv.Itoa(int(d.tm.data_memory[i])),
+				"variablesReference": 0,
+			})
+		}
+	}
+
+	return vars
+}
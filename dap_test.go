@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type dapClient struct {
+	t        *testing.T
+	w        io.Writer
+	messages chan dapMessage
+	seq      int
+	output   strings.Builder
+	skipped  []dapMessage // Messages received while waiting for others
+}
+
+func startDAPSession(t *testing.T) *dapClient {
+	sr, cw := io.Pipe()
+	cr, sw := io.Pipe()
+	t.Cleanup(func() { cw.Close(); cr.Close() })
+
+	go newDAPSession(sw).serve(sr)
+
+	c := &dapClient{t: t, w: cw, messages: make(chan dapMessage, 64)}
+	go func() {
+		reader := bufio.NewReader(cr)
+		for {
+			body, err := readFramed(reader)
+			if err != nil {
+				close(c.messages)
+				return
+			}
+			var msg dapMessage
+			json.Unmarshal(body, &msg)
+			c.messages <- msg
+		}
+	}()
+
+	return c
+}
+
+func (c *dapClient) request(command string, args interface{}) {
+	c.seq++
+	raw, _ := json.Marshal(args)
+	writeFramed(c.w, dapMessage{Seq: c.seq, Type: "request", Command: command, Arguments: raw})
+}
+
+// Wait for the response to a command, or an event, collecting output
+// events along the way. Events from the running program can overtake
+// responses, so other messages are kept for later.
+func (c *dapClient) expect(kind, name string) map[string]interface{} {
+	matches := func(msg dapMessage) bool {
+		return msg.Type == kind && (msg.Command == name || msg.Event == name)
+	}
+
+	for i, msg := range c.skipped {
+		if matches(msg) {
+			c.skipped = append(c.skipped[:i], c.skipped[i+1:]...)
+			return c.body(msg)
+		}
+	}
+
+	for msg := range c.messages {
+		if msg.Type == "event" && msg.Event == "output" {
+			c.output.WriteString(msg.Body.(map[string]interface{})["output"].(string))
+		} else if matches(msg) {
+			return c.body(msg)
+		} else {
+			c.skipped = append(c.skipped, msg)
+		}
+	}
+
+	c.t.Fatalf("Expected %s %s before the session ended.", name, kind)
+	return nil
+}
+
+func (c *dapClient) body(msg dapMessage) map[string]interface{} {
+	if msg.Type == "response" && !msg.Success {
+		c.t.Fatalf("Expected %s to succeed. Got %q.", msg.Command, msg.Message)
+	}
+	body, _ := msg.Body.(map[string]interface{})
+	return body
+}
+
+func TestDAPSession(t *testing.T) {
+	program := filepath.Join(t.TempDir(), "double.tm")
+	src := "* Double a number\nIN 1,0,0\nADD 2,1,1\n\nOUT 2,0,0\nHALT 0,0,0\n"
+	if err := os.WriteFile(program, []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c := startDAPSession(t)
+	c.request("initialize", map[string]string{"adapterID": "tinyvm"})
+	c.expect("response", "initialize")
+	c.expect("event", "initialized")
+
+	c.request("launch", map[string]string{"program": program})
+	c.expect("response", "launch")
+
+	// Line 4 is blank, so the breakpoint moves to the OUT on line 5.
+	c.request("setBreakpoints", map[string]interface{}{
+		"source":      map[string]string{"path": program},
+		"breakpoints": []map[string]int{{"line": 4}},
+	})
+	bps := c.expect("response", "setBreakpoints")["breakpoints"].([]interface{})
+	if bp := bps[0].(map[string]interface{}); bp["verified"] != true || bp["line"] != 5.0 {
+		t.Errorf("Expected breakpoint to be verified at line 5. Got %v.", bp)
+	}
+
+	c.request("configurationDone", nil)
+	c.expect("response", "configurationDone")
+	c.request("evaluate", map[string]string{"expression": "21", "context": "repl"})
+	c.expect("response", "evaluate")
+
+	if reason := c.expect("event", "stopped")["reason"]; reason != "breakpoint" {
+		t.Errorf("Expected to stop at a breakpoint. Got %v.", reason)
+	}
+	if !strings.Contains(c.output.String(), "Enter number to store in register 1") {
+		t.Errorf("Expected IN to prompt in the debug console. Got %q.", c.output.String())
+	}
+
+	c.request("stackTrace", map[string]int{"threadId": 1})
+	frame := c.expect("response", "stackTrace")["stackFrames"].([]interface{})[0].(map[string]interface{})
+	if frame["line"] != 5.0 {
+		t.Errorf("Expected to be stopped at line 5. Got %v.", frame["line"])
+	}
+
+	c.request("variables", map[string]int{"variablesReference": dapRegisters})
+	vars := c.expect("response", "variables")["variables"].([]interface{})
+	if len(vars) != NUM_REGS || vars[2].(map[string]interface{})["value"] != "42" || vars[7].(map[string]interface{})["name"] != "pc" {
+		t.Errorf("Expected r2 to be 42. Got %v.", vars)
+	}
+
+	c.request("variables", map[string]int{"variablesReference": dapDataMemory, "start": 0, "count": 2})
+	vars = c.expect("response", "variables")["variables"].([]interface{})
+	if len(vars) != 2 || vars[0].(map[string]interface{})["value"] != fmt.Sprint(DEF_MEM_SIZE-1) {
+		t.Errorf("Expected the first two words of memory. Got %v.", vars)
+	}
+
+	c.output.Reset()
+	c.request("next", map[string]int{"threadId": 1})
+	c.expect("response", "next")
+	if reason := c.expect("event", "stopped")["reason"]; reason != "step" || c.output.String() != "42\n" {
+		t.Errorf("Expected to step over OUT 42. Got %v with output %q.", reason, c.output.String())
+	}
+
+	c.request("continue", map[string]int{"threadId": 1})
+	c.expect("response", "continue")
+	c.expect("event", "exited")
+	c.expect("event", "terminated")
+
+	c.request("disconnect", nil)
+	c.expect("response", "disconnect")
+}
+
+func TestDAPBreakpointConditionError(t *testing.T) {
+	program := filepath.Join(t.TempDir(), "one.tm")
+	src := "LDC 1,1(0)\nOUT 1,0,0\nHALT 0,0,0\n"
+	if err := os.WriteFile(program, []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c := startDAPSession(t)
+	c.request("initialize", map[string]string{"adapterID": "tinyvm"})
+	c.expect("response", "initialize")
+	c.request("launch", map[string]interface{}{"program": program, "stopOnEntry": true})
+	c.expect("response", "launch")
+	c.request("setBreakpoints", map[string]interface{}{
+		"source":      map[string]string{"path": program},
+		"breakpoints": []map[string]interface{}{{"line": 2, "condition": "mem[0-5] == 1"}},
+	})
+	c.expect("response", "setBreakpoints")
+	c.request("configurationDone", nil)
+	c.expect("response", "configurationDone")
+	c.expect("event", "stopped")
+
+	// Saying the condition failed mustn't deadlock the session.
+	c.request("continue", map[string]int{"threadId": 1})
+	c.expect("response", "continue")
+	if reason := c.expect("event", "stopped")["reason"]; reason != "breakpoint" {
+		t.Errorf("Expected to stop at the breakpoint. Got %v.", reason)
+	}
+	if !strings.Contains(c.output.String(), "Error in breakpoint condition: Invalid memory address: -5") {
+		t.Errorf("Expected the condition's error in the debug console. Got %q.", c.output.String())
+	}
+
+	c.request("disconnect", nil)
+	c.expect("response", "disconnect")
+}
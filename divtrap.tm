@@ -0,0 +1,18 @@
+* Install a fault handler at address 6, recording faults in the three
+* words of data memory starting at address 100.
+LDC  1,100(0)
+TVEC 1,6(0)
+* Divide by zero. The handler reports the fault and execution resumes
+* with the instruction following the DIV.
+LDC  2,7(0)
+DIV  3,2,0
+OUT  2,0,0
+HALT 0,0,0
+* The fault handler. Output the cause of the fault, then bump the saved
+* PC past the faulting instruction and return.
+LD   4,1(1)
+OUT  4,0,0
+LD   4,0(1)
+LDA  4,1(4)
+ST   4,0(1)
+RTT  0,0,0
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// In unified memory, each instruction is encoded in a single word:
+//
+//	bits 26-31  opcode number (position in the opcodes table)
+//	bits 23-25  r
+//	bits 20-22  t
+//	bits  0-19  d, as a signed value
+//
+// Register-only instructions keep their s register in the d field and SYS
+// keeps its call number there. Opcode 0 is HALT, so zeroed memory decodes
+// as HALT 0,0,0.
+const (
+	ENC_OP_SHIFT = 26
+	ENC_R_SHIFT  = 23
+	ENC_T_SHIFT  = 20
+	ENC_D_BITS   = 20
+	ENC_REG_MASK = 0x7
+	ENC_OP_MASK  = 0x3f
+	ENC_D_MIN    = -(1 << (ENC_D_BITS - 1))
+	ENC_D_MAX    = 1<<(ENC_D_BITS-1) - 1
+)
+
+// Encode an instruction as a single word of unified memory.
+func (ti TinyInstruction) encode() (int32, error) {
+	opnum, ok := opcodeNumbers[ti.iop]
+	if !ok {
+		return 0, errors.New("Invalid opcode: '" + ti.iop + "'")
+	}
+
+	r, d, t := ti.iargs[0], ti.iargs[1], ti.iargs[2]
+	if ti.ioptype == iopSY {
+		r, d, t = 0, ti.iargs[0], 0
+	}
+
+	if d < ENC_D_MIN || d > ENC_D_MAX {
+		return 0, fmt.Errorf("Operand out of range for unified memory: %d", d)
+	}
+
+	word := uint32(opnum)<<ENC_OP_SHIFT |
+		uint32(r)<<ENC_R_SHIFT |
+		uint32(t)<<ENC_T_SHIFT |
+		uint32(d)&(1<<ENC_D_BITS-1)
+
+	return int32(word), nil
+}
+
+// Blame an error encoding an instruction parsed from line on the operand
+// held in d, the only one that can be out of range.
+func encodeError(line string, ti TinyInstruction, err error) *ParseError {
+	n := 1
+	if ti.ioptype == iopSY {
+		n = 0
+	}
+
+	// Operands alternate with punctuation after the mnemonic.
+	tok := lexLine(line)[1+2*n]
+	return parseError(tok.column, tok.text, err.Error())
+}
+
+// Decode a word of unified memory into an instruction. Words that don't
+// hold a valid instruction are reported as errors.
+func decodeInstruction(word int32) (TinyInstruction, error) {
+	var ti TinyInstruction
+
+	uword := uint32(word)
+	opnum := uword >> ENC_OP_SHIFT & ENC_OP_MASK
+	if int(opnum) >= len(opcodes) {
+		return ti, fmt.Errorf("Invalid opcode number %d in word %d", opnum, word)
+	}
+
+	r := int32(uword >> ENC_R_SHIFT & ENC_REG_MASK)
+	t := int32(uword >> ENC_T_SHIFT & ENC_REG_MASK)
+	d := int32(uword<<(32-ENC_D_BITS)) >> (32 - ENC_D_BITS) // Sign extend
+
+	ti.iop = opcodes[opnum].name
+	ti.ioptype = opcodes[opnum].ioptype
+	switch ti.ioptype {
+	case iopRO:
+		if d < 0 || d >= NUM_REGS {
+			return TinyInstruction{}, fmt.Errorf("Invalid register %d in word %d", d, word)
+		}
+		ti.iargs = []int32{r, d, t}
+	case iopSY:
+		if d < 0 || r != 0 || t != 0 {
+			return TinyInstruction{}, fmt.Errorf("Invalid system call in word %d", word)
+		}
+		ti.iargs = []int32{d, 0, 0}
+	default:
+		ti.iargs = []int32{r, d, t}
+	}
+
+	return ti, nil
+}
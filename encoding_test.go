@@ -0,0 +1,68 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestEncodeInstruction(t *testing.T) {
+	cases := []struct {
+		in       TinyInstruction
+		want_err string
+	}{
+		{TinyInstruction{"HALT", []int32{0, 0, 0}, iopRO}, ""},
+		{TinyInstruction{"ADD", []int32{7, 6, 5}, iopRO}, ""},
+		{TinyInstruction{"LD", []int32{1, -1, 2}, iopRM}, ""},
+		{TinyInstruction{"LDC", []int32{3, ENC_D_MAX, 0}, iopRA}, ""},
+		{TinyInstruction{"LDA", []int32{3, ENC_D_MIN, 7}, iopRA}, ""},
+		{TinyInstruction{"JNE", []int32{0, -3, 7}, iopRA}, ""},
+		{TinyInstruction{"SYS", []int32{12, 0, 0}, iopSY}, ""},
+		{TinyInstruction{"RTI", []int32{0, 0, 0}, iopRO}, ""},
+		{TinyInstruction{"LDC", []int32{3, ENC_D_MAX + 1, 0}, iopRA},
+			"Operand out of range for unified memory: 524288"},
+		{TinyInstruction{"LDC", []int32{3, ENC_D_MIN - 1, 0}, iopRA},
+			"Operand out of range for unified memory: -524289"},
+		{TinyInstruction{"NOPE", []int32{0, 0, 0}, iopRO}, "Invalid opcode: 'NOPE'"},
+	}
+	for i, c := range cases {
+		word, err := c.in.encode()
+		if err != nil {
+			if c.want_err == "" {
+				t.Errorf("%d: Unexpected error encoding %v: %q.", i, c.in, err.Error())
+			} else if c.want_err != err.Error() {
+				t.Errorf("%d: Expected error '%q' but got '%q'.", i, c.want_err, err.Error())
+			}
+			continue
+		} else if c.want_err != "" {
+			t.Errorf("%d: Expected error encoding %v.", i, c.in)
+			continue
+		}
+
+		got, err := decodeInstruction(word)
+		if err != nil {
+			t.Errorf("%d: Unexpected error decoding %v: %q.", i, c.in, err.Error())
+		} else if !reflect.DeepEqual(got, c.in) {
+			t.Errorf("%d: decodeInstruction(%d) == %v, want %v.", i, word, got, c.in)
+		}
+	}
+
+	// Zeroed memory decodes as HALT.
+	if got, err := decodeInstruction(0); err != nil ||
+		!reflect.DeepEqual(got, TinyInstruction{"HALT", []int32{0, 0, 0}, iopRO}) {
+		t.Errorf("decodeInstruction(0) == %v, %v, want HALT 0,0,0.", got, err)
+	}
+}
+
+func TestDecodeInvalidInstruction(t *testing.T) {
+	cases := []int32{
+		-1,                                     // Opcode number out of range
+		int32(len(opcodes)) << ENC_OP_SHIFT,    // First unused opcode number
+		opcodeNumbers["ADD"]<<ENC_OP_SHIFT | 8, // Bad s register
+		opcodeNumbers["SYS"]<<ENC_OP_SHIFT | 1<<ENC_R_SHIFT,
+	}
+	for i, word := range cases {
+		if got, err := decodeInstruction(word); err == nil {
+			t.Errorf("%d: Expected error decoding %d. Got %v.", i, word, got)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+)
+
+// A ParseError is a problem with a line of a program. The position is
+// left out of the message when the line isn't known, as when parsing a
+// single instruction.
+type ParseError struct {
+	File   string // The program, if known
+	Line   int    // Line number, from 1, or 0 if not known
+	Column int    // Column of the offending token, from 1
+	Token  string // The offending token
+	Msg    string // What's wrong
+}
+
+func (e *ParseError) Error() string {
+	if e.Line == 0 {
+		return e.Msg
+	}
+	return fmt.Sprintf("%s:%d:%d: %s", e.File, e.Line, e.Column, e.Msg)
+}
+
+func parseError(column int, token, msg string) *ParseError {
+	return &ParseError{Column: column, Token: token, Msg: msg}
+}
+
+// A FaultError describes the fault that stopped a machine.
+type FaultError struct {
+	Cause       TinyCPUState
+	PC          int32            // Address of the instruction that faulted
+	Instruction *TinyInstruction // The instruction, or nil if it couldn't be fetched
+	Addr        int32            // The address involved, such as the one accessed
+	Err         error            // The system call's error, for cpuSYS_ERR
+}
+
+func (e *FaultError) Error() string {
+	msg := fmt.Sprintf("%s at PC %d", e.Cause, e.PC)
+	if e.Instruction != nil {
+		msg += fmt.Sprintf(" (%v)", *e.Instruction)
+	}
+	msg += fmt.Sprintf(", address %d", e.Addr)
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+func (e *FaultError) Unwrap() error {
+	return e.Err
+}
+
+// Fault returns the fault that stopped the machine, or nil if it's running
+// or halted normally.
+func (tm *TinyMachine) Fault() error {
+	if tm.cpustate == cpuOK || tm.cpustate == cpuHALTED {
+		return nil
+	}
+
+	e := &FaultError{Cause: tm.cpustate, PC: tm.faultpc, Addr: tm.faultaddr}
+	if ti, ok := tm.instructionAt(tm.faultpc); ok {
+		e.Instruction = &ti
+	}
+	if tm.cpustate == cpuSYS_ERR {
+		e.Err = tm.syserr
+	}
+	return e
+}
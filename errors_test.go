@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseErrorPosition(t *testing.T) {
+	cases := []struct {
+		line   string
+		column int
+		token  string
+	}{
+		{"  FOO 1,2,3", 3, "FOO"},
+		{"ADD  1,2", 6, "1,2"},
+		{"ADD 1,9,3", 7, "9"},
+		{"ADD 1,2,x", 9, "x"},
+		{" LD 1,2(8)", 9, "8"},
+		{"LD 1,a(2)", 6, "a"},
+		{"LD 1,2", 4, "1,2"},
+		{"SYS -1", 5, "-1"},
+		{"HALT", 1, "HALT"},
+		{"add\t1, 2, 9 ; r9", 11, "9"},
+		{"  ld 1,2", 6, "1,2"},
+	}
+
+	for i, c := range cases {
+		_, err := parseInstruction(c.line)
+		var perr *ParseError
+		if !errors.As(err, &perr) {
+			t.Errorf("%d: Expected a ParseError. Got %v.", i, err)
+		} else if perr.Column != c.column || perr.Token != c.token {
+			t.Errorf("%d: Expected %q at column %d. Got %q at column %d.", i, c.token, c.column, perr.Token, perr.Column)
+		}
+	}
+}
+
+func TestDirectiveErrorPosition(t *testing.T) {
+	cases := []struct {
+		line   string
+		column int
+		token  string
+	}{
+		{".protect x 2 ro", 10, "x"},
+		{" .protect 1  y ro", 14, "y"},
+		{".protect 1 2 rw ; comment", 14, "rw"},
+		{".protect 5 2 ro", 10, "5 2"},
+		{".priority p", 11, "p"},
+		{".data 5 1 y", 11, "y"},
+		{".data 1023 1 2", 7, "1023 1 2"},
+		{".data 10", 1, ".data 10"},
+		{"  .bogus 1", 3, ".bogus"},
+	}
+
+	for i, c := range cases {
+		var tm TinyMachine
+		tm.stdout = &bytes.Buffer{}
+		tm.initializeMachine(true)
+
+		err := tm.loadDirective(c.line)
+		var perr *ParseError
+		if !errors.As(err, &perr) {
+			t.Errorf("%d: Expected a ParseError. Got %v.", i, err)
+		} else if perr.Column != c.column || perr.Token != c.token {
+			t.Errorf("%d: Expected %q at column %d. Got %q at column %d.", i, c.token, c.column, perr.Token, perr.Column)
+		}
+	}
+}
+
+func TestEncodeErrorPosition(t *testing.T) {
+	cases := []struct {
+		line   string
+		column int
+		token  string
+	}{
+		{"LDC 1,600000(0)", 7, "600000"},
+		{" LDA 2, -600000 (1)", 9, "-600000"},
+		{"SYS 600000", 5, "600000"},
+	}
+
+	for i, c := range cases {
+		ti, err := parseInstruction(c.line)
+		if err != nil {
+			t.Fatalf("%d: Unexpected error %v.", i, err)
+		}
+		_, err = ti.encode()
+		if err == nil {
+			t.Fatalf("%d: Expected %q not to encode.", i, c.line)
+		}
+
+		perr := encodeError(c.line, ti, err)
+		if perr.Column != c.column || perr.Token != c.token || perr.Msg != err.Error() {
+			t.Errorf("%d: Expected %q at column %d. Got %q at column %d.", i, c.token, c.column, perr.Token, perr.Column)
+		}
+	}
+}
+
+func TestLoadProgramErrors(t *testing.T) {
+	var tm TinyMachine
+	tm.stdout = &bytes.Buffer{}
+	tm.unified = true
+
+	prog := "LDC 1,1(0)\nFOO 1,2,3\n* Comment\n.protect 0 1 rw\nLDC 1,600000(0)\nADD 1,2,3\n"
+	err := tm.loadProgram("bad.tm", strings.NewReader(prog))
+	if err == nil {
+		t.Fatalf("Expected the program not to load.")
+	}
+
+	want := "bad.tm:2:1: Invalid opcode: 'FOO'\n" +
+		"bad.tm:4:14: Invalid protection: 'rw'\n" +
+		"bad.tm:5:7: Operand out of range for unified memory: 600000"
+	if err.Error() != want {
+		t.Errorf("Expected every error to be reported. Got %q.", err.Error())
+	}
+
+	var perr *ParseError
+	if !errors.As(err, &perr) || perr.Line != 2 || perr.Token != "FOO" {
+		t.Errorf("Expected the first error to be a ParseError for line 2. Got %#v.", perr)
+	}
+
+	// Lines that fail still take an address.
+	if !reflect.DeepEqual(tm.srclines, []int{1, 2, 5, 6}) {
+		t.Errorf("Expected each instruction line to take an address. Got %v.", tm.srclines)
+	}
+}
+
+func TestLoadProgramTooBig(t *testing.T) {
+	var tm TinyMachine
+	tm.stdout = &bytes.Buffer{}
+
+	for _, unified := range []bool{false, true} {
+		tm.unified = unified
+		prog := strings.Repeat("LDC 1,1(0)\n", DEF_MEM_SIZE) + "HALT 0,0,0\nHALT 0,0,0\nFOO 1,2,3\n"
+
+		err := tm.loadProgram("big.tm", strings.NewReader(prog))
+		want := "big.tm:1025:1: Program doesn't fit in memory of 1024 words\nbig.tm:1027:1: Invalid opcode: 'FOO'"
+		if err == nil || err.Error() != want {
+			t.Errorf("Expected %q loading with unified %t. Got %v.", want, unified, err)
+		}
+	}
+}
+
+func TestFault(t *testing.T) {
+	sysErr := errors.New("no such file")
+	cases := []struct {
+		prog string
+		want FaultError
+		msg  string
+	}{
+		{"LDC 1,5(0)\nLD 2,2000(1)\n",
+			FaultError{Cause: cpuDMEM_ERR, PC: 1, Addr: 2005},
+			"data memory access violation at PC 1 (LD   2,2000(1)), address 2005"},
+		{"SYS 3\n",
+			FaultError{Cause: cpuSYS_ERR, PC: 0, Addr: 0, Err: sysErr},
+			"system call error at PC 0 (SYS  3), address 0: no such file"},
+		{"LDA 7,2000(0)\n",
+			FaultError{Cause: cpuIMEM_ERR, PC: 2000, Addr: 2000},
+			"instruction memory access violation at PC 2000, address 2000"},
+	}
+
+	for i, c := range cases {
+		var tm TinyMachine
+		if err := tm.loadProgram("test", strings.NewReader(c.prog)); err != nil {
+			t.Fatalf("%d: Unexpected error loading program: %s", i, err)
+		}
+		tm.stdout = &bytes.Buffer{}
+		tm.RegisterSyscall(3, func(tm *TinyMachine) error { return sysErr })
+
+		if tm.Fault() != nil {
+			t.Errorf("%d: Expected no fault before running.", i)
+		}
+		tm.runProgram()
+
+		err := tm.Fault()
+		var ferr *FaultError
+		if !errors.As(err, &ferr) {
+			t.Fatalf("%d: Expected a FaultError. Got %v.", i, err)
+		}
+		if ferr.Cause != c.want.Cause || ferr.PC != c.want.PC || ferr.Addr != c.want.Addr || ferr.Err != c.want.Err {
+			t.Errorf("%d: Expected %+v. Got %+v.", i, c.want, *ferr)
+		}
+		if err.Error() != c.msg {
+			t.Errorf("%d: Expected %q. Got %q.", i, c.msg, err.Error())
+		}
+		if c.want.Err != nil && !errors.Is(err, c.want.Err) {
+			t.Errorf("%d: Expected the system call's error to be wrapped.", i)
+		}
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// An expr is an expression over the state of a machine, as used in
+// breakpoint conditions and the print command. Values are 32 bit
+// integers, with comparisons and logical operators giving 1 or 0. The
+// operands are:
+//
+//	123        A decimal number
+//	r0 .. r7   A register
+//	pc         The program counter, r7
+//	mem[e]     The word of data memory at address e
+//	steps      Instructions executed since the machine was reset
+//	hits       Times the breakpoint being checked has been reached
+//
+// The operators, from lowest to highest precedence, are || && == != < <=
+// > >= + - * / % and the unary - and !. Parentheses group.
+type expr struct {
+	op          string // Operator, or one of the operands above
+	val         int32  // Number, or register number
+	left, right *expr
+}
+
+// The values an expression is evaluated against.
+type exprEnv struct {
+	tm   *TinyMachine
+	hits int
+}
+
+var exprPrecedence = [][]string{
+	{"||"},
+	{"&&"},
+	{"==", "!=", "<", "<=", ">", ">="},
+	{"+", "-"},
+	{"*", "/", "%"},
+}
+
+type exprParser struct {
+	tokens []string
+	pos    int
+}
+
+// Split an expression into numbers, names and operators.
+func lexExpr(src string) ([]string, error) {
+	var tokens []string
+
+	for i := 0; i < len(src); {
+		c := src[i]
+		j := i + 1
+
+		switch {
+		case c == ' ' || c == '\t':
+			i++
+			continue
+		case c >= '0' && c <= '9':
+			for j < len(src) && src[j] >= '0' && src[j] <= '9' {
+				j++
+			}
+		case c >= 'a' && c <= 'z':
+			for j < len(src) && (src[j] >= 'a' && src[j] <= 'z' || src[j] >= '0' && src[j] <= '9') {
+				j++
+			}
+		case j < len(src) && slices.Contains([]string{"==", "!=", "<=", ">=", "&&", "||"}, src[i:j+1]):
+			j++
+		case strings.ContainsRune("+-*/%<>!()[]", rune(c)):
+		default:
+			return nil, fmt.Errorf("Invalid character in expression: '%c'", c)
+		}
+
+		tokens = append(tokens, src[i:j])
+		i = j
+	}
+
+	return tokens, nil
+}
+
+func parseExpr(src string) (*expr, error) {
+	tokens, err := lexExpr(src)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &exprParser{tokens: tokens}
+	e, err := p.binary(0)
+	if err != nil {
+		return nil, err
+	} else if p.pos < len(p.tokens) {
+		return nil, errors.New("Unexpected '" + p.tokens[p.pos] + "' in expression")
+	}
+
+	return e, nil
+}
+
+func (p *exprParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *exprParser) expect(token string) error {
+	if p.peek() != token {
+		if p.peek() == "" {
+			return errors.New("Expected '" + token + "' at end of expression")
+		}
+		return errors.New("Expected '" + token + "' but found '" + p.peek() + "'")
+	}
+	p.pos++
+	return nil
+}
+
+// Parse operators of the given precedence level and higher.
+func (p *exprParser) binary(level int) (*expr, error) {
+	if level == len(exprPrecedence) {
+		return p.unary()
+	}
+
+	left, err := p.binary(level + 1)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		op := p.peek()
+		if !slices.Contains(exprPrecedence[level], op) {
+			return left, nil
+		}
+		p.pos++
+
+		right, err := p.binary(level + 1)
+		if err != nil {
+			return nil, err
+		}
+		left = &expr{op: op, left: left, right: right}
+	}
+}
+
+func (p *exprParser) unary() (*expr, error) {
+	token := p.peek()
+	if token == "" {
+		return nil, errors.New("Unexpected end of expression")
+	}
+	p.pos++
+
+	switch {
+	case token == "-" || token == "!":
+		operand, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return &expr{op: token, left: operand}, nil
+	case token == "(":
+		e, err := p.binary(0)
+		if err != nil {
+			return nil, err
+		}
+		return e, p.expect(")")
+	case token[0] >= '0' && token[0] <= '9':
+		n, err := strconv.ParseInt(token, 10, 32)
+		if err != nil {
+			return nil, errors.New("Invalid number: '" + token + "'")
+		}
+		return &expr{op: "num", val: int32(n)}, nil
+	case token == "pc":
+		return &expr{op: "reg", val: PC_REG}, nil
+	case token == "steps" || token == "hits":
+		return &expr{op: token}, nil
+	case token == "mem":
+		if err := p.expect("["); err != nil {
+			return nil, err
+		}
+		addr, err := p.binary(0)
+		if err != nil {
+			return nil, err
+		}
+		return &expr{op: "mem", left: addr}, p.expect("]")
+	case len(token) == 2 && token[0] == 'r' && token[1] >= '0' && token[1] < '0'+NUM_REGS:
+		return &expr{op: "reg", val: int32(token[1] - '0')}, nil
+	}
+
+	return nil, errors.New("Unexpected '" + token + "' in expression")
+}
+
+func exprBool(b bool) int32 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func (e *expr) eval(env exprEnv) (int32, error) {
+	switch e.op {
+	case "num":
+		return e.val, nil
+	case "reg":
+		return env.tm.registers[e.val], nil
+	case "steps":
+		return int32(env.tm.steps), nil
+	case "hits":
+		return int32(env.hits), nil
+	}
+
+	l, err := e.left.eval(env)
+	if err != nil {
+		return 0, err
+	}
+
+	switch e.op {
+	case "-":
+		if e.right == nil {
+			return -l, nil
+		}
+	case "!":
+		return exprBool(l == 0), nil
+	case "mem":
+		addr, ok := env.tm.translate(l, false)
+		if !ok || addr < 0 || addr >= env.tm.mem_size {
+			return 0, fmt.Errorf("Invalid memory address: %d", l)
+		}
+		return env.tm.data_memory[addr], nil
+	case "&&":
+		if l == 0 {
+			return 0, nil
+		}
+	case "||":
+		if l != 0 {
+			return 1, nil
+		}
+	}
+
+	r, err := e.right.eval(env)
+	if err != nil {
+		return 0, err
+	}
+
+	switch e.op {
+	case "&&", "||":
+		return exprBool(r != 0), nil
+	case "==":
+		return exprBool(l == r), nil
+	case "!=":
+		return exprBool(l != r), nil
+	case "<":
+		return exprBool(l < r), nil
+	case "<=":
+		return exprBool(l <= r), nil
+	case ">":
+		return exprBool(l > r), nil
+	case ">=":
+		return exprBool(l >= r), nil
+	case "+":
+		return l + r, nil
+	case "-":
+		return l - r, nil
+	case "*":
+		return l * r, nil
+	case "/", "%":
+		if r == 0 {
+			return 0, errors.New("Division by zero in expression")
+		} else if e.op == "/" {
+			return l / r, nil
+		}
+		return l % r, nil
+	}
+
+	return 0, errors.New("Unknown operator: " + e.op)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestEvalExpr(t *testing.T) {
+	var tm TinyMachine
+	tm.initializeMachine(true)
+	tm.registers[1] = 10
+	tm.registers[2] = -3
+	tm.registers[PC_REG] = 4
+	tm.data_memory[12] = 99
+	tm.steps = 7
+
+	cases := []struct {
+		src  string
+		want int32
+	}{
+		{"42", 42},
+		{"r1 + r2 * 2", 4},
+		{"(r1 + r2) * 2", 14},
+		{"r1 / 3 + r1 % 3", 4},
+		{"-r2 - -1", 4},
+		{"mem[r1+2]", 99},
+		{"mem[0]", DEF_MEM_SIZE - 1},
+		{"pc == 4 && r1 >= 10", 1},
+		{"pc != 4 || r1 < 10", 0},
+		{"!r0 && r2 <= -3 && r1 > r2", 1},
+		{"steps", 7},
+		{"hits == 2", 1},
+		{"r0 && mem[-1]", 0},
+		{"1 || 1 / r0", 1},
+	}
+
+	for i, c := range cases {
+		e, err := parseExpr(c.src)
+		if err != nil {
+			t.Errorf("%d: Unexpected error parsing %q: %s", i, c.src, err)
+			continue
+		}
+		got, err := e.eval(exprEnv{&tm, 2})
+		if err != nil {
+			t.Errorf("%d: Unexpected error evaluating %q: %s", i, c.src, err)
+		} else if got != c.want {
+			t.Errorf("%d: Expected %q to be %d. Got %d.", i, c.src, c.want, got)
+		}
+	}
+}
+
+func TestExprErrors(t *testing.T) {
+	var tm TinyMachine
+	tm.initializeMachine(true)
+
+	cases := []struct {
+		src      string
+		want_err string
+	}{
+		{"", "Unexpected end of expression"},
+		{"r1 +", "Unexpected end of expression"},
+		{"r8", "Unexpected 'r8' in expression"},
+		{"r1 r2", "Unexpected 'r2' in expression"},
+		{"(r1", "Expected ')' at end of expression"},
+		{"mem r1", "Expected '[' but found 'r1'"},
+		{"r1 = 2", "Invalid character in expression: '='"},
+		{"9999999999", "Invalid number: '9999999999'"},
+		{"1 / r0", "Division by zero in expression"},
+		{"mem[1024]", "Invalid memory address: 1024"},
+	}
+
+	for i, c := range cases {
+		e, err := parseExpr(c.src)
+		if err == nil {
+			_, err = e.eval(exprEnv{tm: &tm})
+		}
+		if err == nil || err.Error() != c.want_err {
+			t.Errorf("%d: Expected error %q from %q. Got %v.", i, c.want_err, c.src, err)
+		}
+	}
+}
@@ -0,0 +1,420 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// A gdbStub lets a debugger speaking the GDB remote serial protocol
+// control a TinyMachine. Registers 0 to 7 are reported as 32 bit little
+// endian values, so the PC is register 7. Data memory is presented as
+// bytes, with word n at byte address 4n. Breakpoint addresses are
+// instruction addresses, as held in the PC.
+type gdbStub struct {
+	tm      *TinyMachine
+	conn    io.ReadWriter
+	packets chan string // Packets from the debugger, or "\x03" to interrupt
+	noack   bool
+}
+
+const gdbInterrupt = "\x03"
+
+// The target description, which tells the debugger the names and sizes of
+// the registers, and that register 7 is the PC, rather than leaving it to
+// assume the layout of its default architecture.
+const gdbTargetXML = `<?xml version="1.0"?>
+<!DOCTYPE target SYSTEM "gdb-target.dtd">
+<target version="1.0">
+  <feature name="org.tinyvm.core">
+    <reg name="r0" bitsize="32" type="int32" regnum="0"/>
+    <reg name="r1" bitsize="32" type="int32"/>
+    <reg name="r2" bitsize="32" type="int32"/>
+    <reg name="r3" bitsize="32" type="int32"/>
+    <reg name="r4" bitsize="32" type="int32"/>
+    <reg name="r5" bitsize="32" type="int32"/>
+    <reg name="r6" bitsize="32" type="int32"/>
+    <reg name="pc" bitsize="32" type="code_ptr"/>
+  </feature>
+</target>
+`
+
+// Wait for a debugger to connect on addr and serve it until it detaches.
+func serveGDB(tm *TinyMachine, addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	tm.speak("Waiting for debugger connection on", ln.Addr())
+	conn, err := ln.Accept()
+	ln.Close()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	tm.speak("Debugger connected from", conn.RemoteAddr())
+	return newGDBStub(tm, conn).serve()
+}
+
+func newGDBStub(tm *TinyMachine, conn io.ReadWriter) *gdbStub {
+	stub := &gdbStub{tm: tm, conn: conn, packets: make(chan string, 16)}
+	go stub.readPackets()
+
+	return stub
+}
+
+// Read packets from the debugger, acknowledging them as they arrive.
+func (g *gdbStub) readPackets() {
+	defer close(g.packets)
+	reader := bufio.NewReader(g.conn)
+
+	for {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return
+		}
+
+		switch b {
+		case gdbInterrupt[0]:
+			g.packets <- gdbInterrupt
+		case '$':
+			data, err := reader.ReadString('#')
+			if err != nil {
+				return
+			}
+			data = data[:len(data)-1]
+
+			cs := make([]byte, 2)
+			if _, err := io.ReadFull(reader, cs); err != nil {
+				return
+			}
+
+			sum, err := strconv.ParseUint(string(cs), 16, 8)
+			if err != nil || byte(sum) != gdbChecksum(data) {
+				g.conn.Write([]byte("-"))
+				continue
+			}
+			if !g.noack {
+				g.conn.Write([]byte("+"))
+			}
+			g.packets <- data
+		default:
+			// Acknowledgements from the debugger, which we don't track.
+		}
+	}
+}
+
+func gdbChecksum(data string) byte {
+	var sum byte
+	for i := 0; i < len(data); i++ {
+		sum += data[i]
+	}
+	return sum
+}
+
+func (g *gdbStub) send(data string) error {
+	_, err := fmt.Fprintf(g.conn, "$%s#%02x", data, gdbChecksum(data))
+	return err
+}
+
+// Handle packets until the debugger kills the program or detaches.
+func (g *gdbStub) serve() error {
+	for pkt := range g.packets {
+		if pkt == gdbInterrupt {
+			continue // Nothing is running
+		}
+
+		reply, done := g.handle(pkt)
+		if err := g.send(reply); err != nil {
+			return err
+		}
+		if done {
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// Respond to a single packet. Returns true when the session is over.
+func (g *gdbStub) handle(pkt string) (string, bool) {
+	if pkt == "" {
+		return "", false
+	}
+
+	args := pkt[1:]
+	switch pkt[0] {
+	case '?':
+		return g.stopReply(), false
+	case 'g':
+		return g.readRegisters(), false
+	case 'G':
+		return g.writeRegisters(args), false
+	case 'p':
+		return g.readRegister(args), false
+	case 'P':
+		return g.writeRegister(args), false
+	case 'm':
+		return g.readMemory(args), false
+	case 'M':
+		return g.writeMemory(args), false
+	case 's':
+		return g.resume(true), false
+	case 'c':
+		return g.resume(false), false
+	case 'Z', 'z':
+		return g.breakpoint(pkt[0] == 'Z', args), false
+	case 'H':
+		return "OK", false
+	case 'D':
+		return "OK", true
+	case 'k':
+		return "", true
+	case 'q', 'Q':
+		return g.query(pkt), false
+	}
+
+	return "", false // Unsupported
+}
+
+func (g *gdbStub) query(pkt string) string {
+	switch {
+	case strings.HasPrefix(pkt, "qSupported"):
+		return "PacketSize=4000;QStartNoAckMode+;qXfer:features:read+"
+	case strings.HasPrefix(pkt, "qXfer:features:read:"):
+		return readXfer(gdbTargetXML, strings.TrimPrefix(pkt, "qXfer:features:read:"))
+	case pkt == "QStartNoAckMode":
+		g.noack = true
+		return "OK"
+	case pkt == "qAttached":
+		return "1"
+	case pkt == "qC":
+		return "QC1"
+	case pkt == "qfThreadInfo":
+		return "m1"
+	case pkt == "qsThreadInfo":
+		return "l"
+	}
+
+	return ""
+}
+
+// Answer a read of part of target.xml, given as target.xml:offset,length in
+// hex. The reply starts with m if there's more to read, or l if not.
+func readXfer(doc, args string) string {
+	annex, rest, _ := strings.Cut(args, ":")
+	parts := strings.Split(rest, ",")
+	if annex != "target.xml" || len(parts) != 2 {
+		return "E00"
+	}
+
+	offset, err := strconv.ParseUint(parts[0], 16, 32)
+	if err != nil {
+		return "E01"
+	}
+	length, err := strconv.ParseUint(parts[1], 16, 32)
+	if err != nil {
+		return "E01"
+	}
+
+	if offset >= uint64(len(doc)) {
+		return "l"
+	} else if offset+length >= uint64(len(doc)) {
+		return "l" + doc[offset:]
+	}
+	return "m" + doc[offset:offset+length]
+}
+
+// Describe why the machine is stopped, as a signal number or exit status.
+func (g *gdbStub) stopReply() string {
+	switch g.tm.cpustate {
+	case cpuOK:
+		return "S05" // SIGTRAP
+	case cpuHALTED:
+		return "W00"
+	case cpuDIV_ZERO:
+		return "S08" // SIGFPE
+	case cpuIMEM_ERR, cpuDMEM_ERR, cpuPROT_ERR, cpuPAGE_FAULT:
+		return "S0b" // SIGSEGV
+	case cpuDECODE_ERR, cpuPRIV_ERR:
+		return "S04" // SIGILL
+	}
+
+	return "S06" // SIGABRT
+}
+
+// Step one instruction, or continue until a breakpoint, a fault, the
+// program halting or blocking, or the debugger interrupting.
+func (g *gdbStub) resume(step bool) string {
+	for g.tm.cpustate == cpuOK {
+		g.tm.stepProgram()
+
+		if step || g.tm.blocked || g.tm.atBreakpoint() {
+			break
+		}
+
+		select {
+		case pkt, ok := <-g.packets:
+			if !ok || pkt == gdbInterrupt {
+				return "S02" // SIGINT
+			}
+		default:
+		}
+	}
+
+	return g.stopReply()
+}
+
+func (g *gdbStub) breakpoint(insert bool, args string) string {
+	// Only software breakpoints, type 0, are supported.
+	parts := strings.Split(args, ",")
+	if len(parts) < 2 || parts[0] != "0" {
+		return ""
+	}
+
+	addr, err := strconv.ParseUint(parts[1], 16, 32)
+	if err != nil {
+		return "E01"
+	}
+
+	if insert {
+		g.tm.setBreakpoint(int32(addr))
+	} else {
+		delete(g.tm.breakpoints, int32(addr))
+	}
+
+	return "OK"
+}
+
+func encodeWord(v int32) string {
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, uint32(v))
+	return hex.EncodeToString(b)
+}
+
+func decodeWord(s string) (int32, error) {
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != 4 {
+		return 0, fmt.Errorf("Invalid word: %q", s)
+	}
+	return int32(binary.LittleEndian.Uint32(b)), nil
+}
+
+func (g *gdbStub) readRegisters() string {
+	var regs strings.Builder
+	for _, v := range g.tm.registers {
+		regs.WriteString(encodeWord(v))
+	}
+	return regs.String()
+}
+
+func (g *gdbStub) writeRegisters(args string) string {
+	if len(args) != NUM_REGS*8 {
+		return "E01"
+	}
+
+	var regs [NUM_REGS]int32
+	for i := range regs {
+		v, err := decodeWord(args[i*8 : i*8+8])
+		if err != nil {
+			return "E01"
+		}
+		regs[i] = v
+	}
+	g.tm.registers = regs
+
+	return "OK"
+}
+
+func (g *gdbStub) readRegister(args string) string {
+	n, err := strconv.ParseUint(args, 16, 32)
+	if err != nil || n >= NUM_REGS {
+		return "E01"
+	}
+	return encodeWord(g.tm.registers[n])
+}
+
+func (g *gdbStub) writeRegister(args string) string {
+	parts := strings.SplitN(args, "=", 2)
+	if len(parts) != 2 {
+		return "E01"
+	}
+
+	n, err := strconv.ParseUint(parts[0], 16, 32)
+	if err != nil || n >= NUM_REGS {
+		return "E01"
+	}
+	v, err := decodeWord(parts[1])
+	if err != nil {
+		return "E01"
+	}
+	g.tm.registers[n] = v
+
+	return "OK"
+}
+
+// Parse the addr,length arguments of a memory packet, checking that the
+// bytes lie within data memory.
+func (g *gdbStub) memoryRange(args string) (uint64, uint64, bool) {
+	parts := strings.Split(args, ",")
+	if len(parts) != 2 {
+		return 0, 0, false
+	}
+
+	addr, err := strconv.ParseUint(parts[0], 16, 32)
+	if err != nil {
+		return 0, 0, false
+	}
+	length, err := strconv.ParseUint(parts[1], 16, 32)
+	if err != nil || addr+length > uint64(g.tm.mem_size)*4 {
+		return 0, 0, false
+	}
+
+	return addr, length, true
+}
+
+func (g *gdbStub) readMemory(args string) string {
+	addr, length, ok := g.memoryRange(args)
+	if !ok {
+		return "E01"
+	}
+
+	b := make([]byte, length)
+	for i := range b {
+		word := uint32(g.tm.data_memory[(addr+uint64(i))/4])
+		b[i] = byte(word >> ((addr + uint64(i)) % 4 * 8))
+	}
+
+	return hex.EncodeToString(b)
+}
+
+func (g *gdbStub) writeMemory(args string) string {
+	parts := strings.SplitN(args, ":", 2)
+	if len(parts) != 2 {
+		return "E01"
+	}
+
+	addr, length, ok := g.memoryRange(parts[0])
+	b, err := hex.DecodeString(parts[1])
+	if !ok || err != nil || uint64(len(b)) != length {
+		return "E01"
+	}
+
+	for i, v := range b {
+		a := addr + uint64(i)
+		shift := a % 4 * 8
+		word := uint32(g.tm.data_memory[a/4])
+		word = word&^(0xff<<shift) | uint32(v)<<shift
+		g.tm.data_memory[a/4] = int32(word)
+		g.tm.noteMemoryWrite(int32(a/4), g.tm.registers[PC_REG], "edit")
+	}
+
+	return "OK"
+}
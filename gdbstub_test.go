@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+)
+
+// Start a stub for the program, returning a function that sends a packet,
+// followed by any extra bytes, and returns the reply.
+func startGDBStub(t *testing.T, prog string) (*TinyMachine, func(string, ...byte) string) {
+	var tm TinyMachine
+	if err := tm.loadProgram("test", bytes.NewBufferString(prog)); err != nil {
+		t.Fatalf("Unexpected error loading program.")
+	}
+
+	client, server := net.Pipe()
+	t.Cleanup(func() { client.Close() })
+	stub := newGDBStub(&tm, server)
+	go stub.serve()
+
+	reader := bufio.NewReader(client)
+	return &tm, func(pkt string, extra ...byte) string {
+		pkt = fmt.Sprintf("$%s#%02x", pkt, gdbChecksum(pkt))
+		go client.Write(append([]byte(pkt), extra...))
+
+		if ack, err := reader.ReadByte(); err != nil || ack != '+' {
+			t.Fatalf("Expected packet %q to be acknowledged. Got %q.", pkt, ack)
+		}
+		reply, err := reader.ReadString('#')
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader.Discard(2)
+
+		return strings.TrimPrefix(strings.TrimSuffix(reply, "#"), "$")
+	}
+}
+
+func TestGDBStub(t *testing.T) {
+	tm, send := startGDBStub(t, "LDC 1,258(0)\nST 1,1(0)\nLDA 2,1(2)\nLDA 7,-2(7)\n")
+
+	cases := []struct {
+		pkt  string
+		want string
+	}{
+		{"qSupported:multiprocess+", "PacketSize=4000;QStartNoAckMode+;qXfer:features:read+"},
+		{"qXfer:features:read:target.xml:0,15", "m" + gdbTargetXML[:0x15]},
+		{fmt.Sprintf("qXfer:features:read:target.xml:%x,1", len(gdbTargetXML)), "l"},
+		{"qXfer:features:read:other.xml:0,15", "E00"},
+		{"?", "S05"},
+		{"s", "S05"},
+		{"p1", "02010000"},
+		{"p8", "E01"},
+		{"g", "00000000020100000000000000000000000000000000000000000000" + "01000000"},
+		{"s", "S05"},
+		{"m0,2", "ff03"},
+		{"m4,6", "020100000000"},
+		{"M8,2:0a00", "OK"},
+		{"m8,4", "0a000000"},
+		{fmt.Sprintf("m%x,1", DEF_MEM_SIZE*4), "E01"},
+		{"P3=2a000000", "OK"},
+		{"p3", "2a000000"},
+		{"Z0,3,4", "OK"},
+		{"c", "S05"},
+		{"p7", "03000000"},
+		{"c", "S05"},
+		{"p2", "02000000"},
+		{"z0,3,4", "OK"},
+		{"Z1,3,4", ""},
+		{"vMustReplyEmpty", ""},
+	}
+	for i, c := range cases {
+		if got := send(c.pkt); got != c.want {
+			t.Errorf("%d: Expected %q to get %q. Got %q.", i, c.pkt, c.want, got)
+		}
+	}
+
+	if tm.data_memory[2] != 10 {
+		t.Errorf("Expected memory write to set address 2 to 10. Got %d.", tm.data_memory[2])
+	}
+}
+
+func TestGDBTargetDescription(t *testing.T) {
+	_, send := startGDBStub(t, "HALT 0,0,0\n")
+
+	// Read it in pieces, as a debugger does.
+	var doc string
+	for {
+		reply := send(fmt.Sprintf("qXfer:features:read:target.xml:%x,40", len(doc)))
+		doc += reply[1:]
+		if reply[0] == 'l' {
+			break
+		} else if reply[0] != 'm' || len(doc) > len(gdbTargetXML) {
+			t.Fatalf("Unexpected reply %q.", reply)
+		}
+	}
+
+	if doc != gdbTargetXML {
+		t.Errorf("Expected the whole target description. Got %q.", doc)
+	}
+	regs := strings.Count(doc, `bitsize="32"`)
+	if regs != NUM_REGS || !strings.Contains(doc, `<reg name="pc" bitsize="32" type="code_ptr"/>`) {
+		t.Errorf("Expected %d 32 bit registers, the last of them the PC. Got %d.", NUM_REGS, regs)
+	}
+}
+
+func TestGDBStubStops(t *testing.T) {
+	cases := []struct {
+		prog string
+		want string
+	}{
+		{"HALT 0,0,0\n", "W00"},
+		{"DIV 0,0,0\n", "S08"},
+		{"LD 0,-1(0)\n", "S0b"},
+	}
+	for i, c := range cases {
+		_, send := startGDBStub(t, c.prog)
+		if got := send("c"); got != c.want {
+			t.Errorf("%d: Expected %q. Got %q.", i, c.want, got)
+		}
+	}
+
+	// The debugger can interrupt a program that never stops.
+	_, send := startGDBStub(t, spinProgram)
+	if got := send("c", gdbInterrupt[0]); got != "S02" {
+		t.Errorf("Expected interrupt to stop the program. Got %q.", got)
+	}
+}
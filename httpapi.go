@@ -0,0 +1,417 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The number of instructions a run executes if no budget is given.
+const DEF_RUN_BUDGET = 100000
+
+// An apiSession is a machine controlled through the HTTP API. Input for
+// IN is queued by the client, and values written by OUT are kept until the
+// client fetches them, along with any other messages from the machine.
+type apiSession struct {
+	mu       sync.Mutex
+	id       string
+	tm       *TinyMachine
+	steps    int
+	input    bytes.Buffer // Queued lines for IN
+	outputs  []int32      // Values written by OUT since the last fetch
+	messages bytes.Buffer // Everything else the machine said
+}
+
+// An apiServer routes requests to sessions. The endpoints are:
+//
+//	POST   /sessions                 {"program": "...", "unified": false}
+//	GET    /sessions/{id}
+//	DELETE /sessions/{id}
+//	POST   /sessions/{id}/step       {"count": 1}
+//	POST   /sessions/{id}/run        {"budget": 100000}
+//	POST   /sessions/{id}/reset
+//	GET    /sessions/{id}/registers
+//	PUT    /sessions/{id}/registers  {"registers": {"3": 42}}
+//	GET    /sessions/{id}/memory?start=0&count=16
+//	PUT    /sessions/{id}/memory     {"start": 0, "values": [1, 2]}
+//	POST   /sessions/{id}/input      {"values": [1, 2]}
+//	GET    /sessions/{id}/output
+//
+// Request bodies are optional where every field has a default.
+type apiServer struct {
+	mu       sync.Mutex
+	sessions map[string]*apiSession
+	nextid   int
+}
+
+// The state of a session's machine, returned by most endpoints.
+type apiState struct {
+	ID              string          `json:"id"`
+	State           string          `json:"state"`
+	PC              int32           `json:"pc"`
+	Registers       [NUM_REGS]int32 `json:"registers"`
+	Steps           int             `json:"steps"`
+	WaitingForInput bool            `json:"waiting_for_input"`
+}
+
+func serveHTTP(addr string) error {
+	fmt.Println("Serving the control API on", addr)
+	return http.ListenAndServe(addr, newAPIServer().handler())
+}
+
+func newAPIServer() *apiServer {
+	return &apiServer{sessions: make(map[string]*apiSession)}
+}
+
+type apiHandler func(s *apiSession, r *http.Request) (interface{}, error)
+
+// Session endpoints, by method and the part of the path after the ID.
+var apiRoutes = map[string]apiHandler{
+	"GET ":          apiGetState,
+	"POST step":     apiStep,
+	"POST run":      apiRun,
+	"POST reset":    apiReset,
+	"GET registers": apiGetRegisters,
+	"PUT registers": apiSetRegisters,
+	"GET memory":    apiGetMemory,
+	"PUT memory":    apiSetMemory,
+	"POST input":    apiInput,
+	"GET output":    apiOutput,
+}
+
+func (a *apiServer) handler() http.Handler {
+	return http.HandlerFunc(a.route)
+}
+
+func (a *apiServer) route(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if parts[0] != "sessions" || len(parts) > 3 {
+		writeError(w, &apiError{http.StatusNotFound, "Not found: " + r.URL.Path})
+		return
+	}
+
+	if len(parts) == 1 {
+		if r.Method != http.MethodPost {
+			writeError(w, &apiError{http.StatusMethodNotAllowed, "Method not allowed: " + r.Method})
+			return
+		}
+		a.create(w, r)
+		return
+	}
+
+	id, endpoint := parts[1], ""
+	if len(parts) == 3 {
+		endpoint = parts[2]
+	}
+	if r.Method == http.MethodDelete && endpoint == "" {
+		a.remove(w, id)
+		return
+	}
+
+	handle, ok := apiRoutes[r.Method+" "+endpoint]
+	if !ok {
+		writeError(w, &apiError{http.StatusNotFound, "Not found: " + r.Method + " " + r.URL.Path})
+		return
+	}
+
+	a.mu.Lock()
+	s, ok := a.sessions[id]
+	a.mu.Unlock()
+	if !ok {
+		writeError(w, &apiError{http.StatusNotFound, "No such session: " + id})
+		return
+	}
+
+	result, err := s.call(handle, r)
+	if err != nil {
+		writeError(w, err)
+	} else {
+		writeJSON(w, http.StatusOK, result)
+	}
+}
+
+// Run a handler on the session. The lock is released even if the handler
+// panics, so that one bad request can't hang the session.
+func (s *apiSession) call(handle apiHandler, r *http.Request) (interface{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return handle(s, r)
+}
+
+// An apiError is reported to the client with its HTTP status.
+type apiError struct {
+	status int
+	msg    string
+}
+
+func (e *apiError) Error() string {
+	return e.msg
+}
+
+func badRequest(msg string) error {
+	return &apiError{http.StatusBadRequest, msg}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	var apierr *apiError
+	if errors.As(err, &apierr) {
+		status = apierr.status
+	}
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// Decode an optional JSON request body into v.
+func readJSON(r *http.Request, v interface{}) error {
+	err := json.NewDecoder(r.Body).Decode(v)
+	if err == io.EOF {
+		return nil
+	} else if err != nil {
+		return badRequest("Invalid request body: " + err.Error())
+	}
+	return nil
+}
+
+func (a *apiServer) create(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Program string `json:"program"`
+		Unified bool   `json:"unified"`
+	}
+	if err := readJSON(r, &req); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	s := &apiSession{}
+	s.tm = &TinyMachine{
+		unified: req.Unified,
+		stdin:   bufio.NewReader(&s.input),
+		stdout:  &s.messages,
+		outhook: func(v int32) { s.outputs = append(s.outputs, v) },
+	}
+	if err := s.tm.loadProgram("request", strings.NewReader(req.Program)); err != nil {
+		writeError(w, badRequest(err.Error()))
+		return
+	}
+	s.messages.Reset()
+
+	a.mu.Lock()
+	a.nextid++
+	s.id = strconv.Itoa(a.nextid)
+	s.tm.session = s.id
+	a.sessions[s.id] = s
+	a.mu.Unlock()
+
+	writeJSON(w, http.StatusCreated, s.state())
+}
+
+func (a *apiServer) remove(w http.ResponseWriter, id string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if _, ok := a.sessions[id]; !ok {
+		writeError(w, &apiError{http.StatusNotFound, "No such session: " + id})
+		return
+	}
+	delete(a.sessions, id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *apiSession) state() apiState {
+	return apiState{
+		ID:              s.id,
+		State:           s.tm.cpustate.String(),
+		PC:              s.tm.registers[PC_REG],
+		Registers:       s.tm.registers,
+		Steps:           s.steps,
+		WaitingForInput: s.waitingForInput(),
+	}
+}
+
+// Report whether the next instruction is an IN with no input queued for
+// it. Stepping stops there, rather than waiting for input that can only
+// arrive with a later request.
+func (s *apiSession) waitingForInput() bool {
+	if s.tm.cpustate != cpuOK || s.tm.stdin.Buffered() > 0 || s.input.Len() > 0 {
+		return false
+	}
+
+	pc, ok := s.tm.translate(s.tm.registers[PC_REG], false)
+	if !ok || pc < 0 || pc >= s.tm.mem_size {
+		return false
+	}
+	instruction, ok := s.tm.fetch(pc)
+	return ok && instruction.iop == "IN"
+}
+
+// Execute up to count instructions, stopping early if the machine stops,
+// blocks or waits for input. Returns the number executed.
+func (s *apiSession) execute(count int) int {
+	n := 0
+	for n < count && s.tm.cpustate == cpuOK && !s.waitingForInput() {
+		s.tm.stepProgram()
+		n++
+		if s.tm.blocked {
+			break
+		}
+	}
+
+	s.steps += n
+	return n
+}
+
+func apiGetState(s *apiSession, r *http.Request) (interface{}, error) {
+	return s.state(), nil
+}
+
+func apiStep(s *apiSession, r *http.Request) (interface{}, error) {
+	req := struct {
+		Count int `json:"count"`
+	}{1}
+	if err := readJSON(r, &req); err != nil {
+		return nil, err
+	} else if req.Count < 1 {
+		return nil, badRequest("The count must be at least 1.")
+	}
+
+	s.execute(req.Count)
+	return s.state(), nil
+}
+
+func apiRun(s *apiSession, r *http.Request) (interface{}, error) {
+	req := struct {
+		Budget int `json:"budget"`
+	}{DEF_RUN_BUDGET}
+	if err := readJSON(r, &req); err != nil {
+		return nil, err
+	} else if req.Budget < 1 {
+		return nil, badRequest("The budget must be at least 1.")
+	}
+
+	n := s.execute(req.Budget)
+	return struct {
+		apiState
+		Executed  int  `json:"executed"`
+		Exhausted bool `json:"budget_exhausted"`
+	}{s.state(), n, n == req.Budget && s.tm.cpustate == cpuOK}, nil
+}
+
+func apiReset(s *apiSession, r *http.Request) (interface{}, error) {
+	s.tm.resetState()
+	s.steps = 0
+	return s.state(), nil
+}
+
+func apiGetRegisters(s *apiSession, r *http.Request) (interface{}, error) {
+	return map[string]interface{}{"registers": s.tm.registers}, nil
+}
+
+func apiSetRegisters(s *apiSession, r *http.Request) (interface{}, error) {
+	var req struct {
+		Registers map[string]int32 `json:"registers"`
+	}
+	if err := readJSON(r, &req); err != nil {
+		return nil, err
+	}
+
+	regs := s.tm.registers
+	for name, v := range req.Registers {
+		n, err := strconv.Atoi(name)
+		if err != nil || n < 0 || n >= NUM_REGS {
+			return nil, badRequest("Invalid register: " + name)
+		}
+		regs[n] = v
+	}
+	s.tm.registers = regs
+
+	return map[string]interface{}{"registers": s.tm.registers}, nil
+}
+
+func (s *apiSession) checkRange(start, count int) error {
+	// Written so that huge values can't overflow.
+	if start < 0 || count < 0 || start > int(s.tm.mem_size) || count > int(s.tm.mem_size)-start {
+		return badRequest(fmt.Sprintf("Invalid memory range: %d words from %d", count, start))
+	}
+	return nil
+}
+
+func apiGetMemory(s *apiSession, r *http.Request) (interface{}, error) {
+	start, count := 0, int(s.tm.mem_size)
+
+	var err error
+	if v := r.URL.Query().Get("start"); v != "" {
+		if start, err = strconv.Atoi(v); err != nil {
+			return nil, badRequest("Invalid start: " + v)
+		}
+		count -= start
+	}
+	if v := r.URL.Query().Get("count"); v != "" {
+		if count, err = strconv.Atoi(v); err != nil {
+			return nil, badRequest("Invalid count: " + v)
+		}
+	}
+	if err := s.checkRange(start, count); err != nil {
+		return nil, err
+	}
+
+	values := append([]int32{}, s.tm.data_memory[start:start+count]...)
+	return map[string]interface{}{"start": start, "values": values}, nil
+}
+
+func apiSetMemory(s *apiSession, r *http.Request) (interface{}, error) {
+	var req struct {
+		Start  int     `json:"start"`
+		Values []int32 `json:"values"`
+	}
+	if err := readJSON(r, &req); err != nil {
+		return nil, err
+	}
+	if err := s.checkRange(req.Start, len(req.Values)); err != nil {
+		return nil, err
+	}
+
+	copy(s.tm.data_memory[req.Start:], req.Values)
+	for i := range req.Values {
+		s.tm.noteMemoryWrite(int32(req.Start+i), s.tm.registers[PC_REG], "edit")
+	}
+	return map[string]interface{}{"start": req.Start, "values": req.Values}, nil
+}
+
+func apiInput(s *apiSession, r *http.Request) (interface{}, error) {
+	var req struct {
+		Values []int32 `json:"values"`
+	}
+	if err := readJSON(r, &req); err != nil {
+		return nil, err
+	}
+
+	for _, v := range req.Values {
+		fmt.Fprintln(&s.input, v)
+	}
+	return s.state(), nil
+}
+
+// Hand over everything OUT wrote and the machine said since the last fetch.
+func apiOutput(s *apiSession, r *http.Request) (interface{}, error) {
+	result := map[string]interface{}{"values": s.outputs, "messages": s.messages.String()}
+	if s.outputs == nil {
+		result["values"] = []int32{}
+	}
+
+	s.outputs = nil
+	s.messages.Reset()
+	return result, nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func apiCall(t *testing.T, h http.Handler, method, path, body string) (int, map[string]interface{}) {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	var result map[string]interface{}
+	if rec.Code != http.StatusNoContent {
+		if err := json.Unmarshal(rec.Body.Bytes(), &result); err != nil {
+			t.Fatalf("%s %s: Invalid response %q: %s", method, path, rec.Body.String(), err)
+		}
+	}
+	return rec.Code, result
+}
+
+func TestHTTPAPI(t *testing.T) {
+	h := newAPIServer().handler()
+
+	// Sums numbers read until a zero, printing the running total.
+	prog := "IN 1,0,0\nJEQ 1,3(7)\nADD 2,2,1\nOUT 2,0,0\nLDA 7,-5(7)\nHALT 0,0,0\n"
+	body, _ := json.Marshal(map[string]string{"program": prog})
+
+	code, state := apiCall(t, h, "POST", "/sessions", string(body))
+	if code != http.StatusCreated || state["id"] != "1" || state["waiting_for_input"] != true {
+		t.Fatalf("Expected session 1 waiting for input. Got %d %v.", code, state)
+	}
+
+	// Nothing happens without input.
+	_, state = apiCall(t, h, "POST", "/sessions/1/run", "")
+	if state["executed"] != 0.0 || state["budget_exhausted"] != false {
+		t.Errorf("Expected run to stop at IN. Got %v.", state)
+	}
+
+	apiCall(t, h, "POST", "/sessions/1/input", `{"values": [3, 4]}`)
+	_, state = apiCall(t, h, "POST", "/sessions/1/step", `{"count": 2}`)
+	if state["pc"] != 2.0 || state["steps"] != 2.0 {
+		t.Errorf("Expected to step to PC 2. Got %v.", state)
+	}
+
+	_, state = apiCall(t, h, "POST", "/sessions/1/run", "")
+	if state["pc"] != 0.0 || state["waiting_for_input"] != true || state["state"] != "ok" {
+		t.Errorf("Expected to wait for more input at PC 0. Got %v.", state)
+	}
+
+	_, out := apiCall(t, h, "GET", "/sessions/1/output", "")
+	if !reflect.DeepEqual(out["values"], []interface{}{3.0, 7.0}) {
+		t.Errorf("Expected output [3 7]. Got %v.", out["values"])
+	}
+	if !strings.Contains(out["messages"].(string), "Enter number to store in register 1") {
+		t.Errorf("Expected IN prompts in messages. Got %q.", out["messages"])
+	}
+	_, out = apiCall(t, h, "GET", "/sessions/1/output", "")
+	if len(out["values"].([]interface{})) != 0 {
+		t.Errorf("Expected output to be cleared once fetched. Got %v.", out["values"])
+	}
+
+	apiCall(t, h, "POST", "/sessions/1/input", `{"values": [0]}`)
+	_, state = apiCall(t, h, "POST", "/sessions/1/run", `{"budget": 2}`)
+	if state["budget_exhausted"] != true || state["pc"] != 5.0 {
+		t.Errorf("Expected budget to run out at PC 5. Got %v.", state)
+	}
+	_, state = apiCall(t, h, "POST", "/sessions/1/run", "")
+	if state["state"] != "halted" || state["budget_exhausted"] != false {
+		t.Errorf("Expected program to halt. Got %v.", state)
+	}
+
+	_, regs := apiCall(t, h, "PUT", "/sessions/1/registers", `{"registers": {"3": 42}}`)
+	if regs["registers"].([]interface{})[3] != 42.0 {
+		t.Errorf("Expected register 3 to be set. Got %v.", regs)
+	}
+
+	apiCall(t, h, "PUT", "/sessions/1/memory", `{"start": 10, "values": [5, 6]}`)
+	_, mem := apiCall(t, h, "GET", "/sessions/1/memory?start=9&count=3", "")
+	if !reflect.DeepEqual(mem["values"], []interface{}{0.0, 5.0, 6.0}) {
+		t.Errorf("Expected memory to be set. Got %v.", mem)
+	}
+
+	_, state = apiCall(t, h, "POST", "/sessions/1/reset", "")
+	if state["state"] != "ok" || state["steps"] != 0.0 {
+		t.Errorf("Expected session to be reset. Got %v.", state)
+	}
+
+	if code, _ := apiCall(t, h, "DELETE", "/sessions/1", ""); code != http.StatusNoContent {
+		t.Errorf("Expected session to be deleted. Got %d.", code)
+	}
+
+	big, _ := json.Marshal(map[string]string{"program": strings.Repeat("HALT 0,0,0\n", DEF_MEM_SIZE+1)})
+
+	errors := []struct {
+		method string
+		path   string
+		body   string
+		code   int
+		err    string
+	}{
+		{"GET", "/sessions/1", "", 404, "No such session: 1"},
+		{"POST", "/sessions", `{"program": "FOO 1,2,3\nADD 1,2\n"}`, 400,
+			"request:1:1: Invalid opcode: 'FOO'\nrequest:2:5: Invalid arguments for opcode ADD: '1,2'"},
+		{"POST", "/sessions", `{"program": `, 400, "Invalid request body: unexpected EOF"},
+		{"POST", "/sessions", string(big), 400, "request:1025:1: Program doesn't fit in memory of 1024 words"},
+		{"POST", "/sessions/2/step", `{"count": 0}`, 400, "The count must be at least 1."},
+		{"PUT", "/sessions/2/registers", `{"registers": {"8": 1}}`, 400, "Invalid register: 8"},
+		{"GET", "/sessions/2/memory?start=1020&count=5", "", 400, "Invalid memory range: 5 words from 1020"},
+		{"GET", "/sessions/2/memory?start=4611686018427387904&count=4611686018427387904", "", 400,
+			"Invalid memory range: 4611686018427387904 words from 4611686018427387904"},
+		{"PUT", "/sessions/2/memory", `{"start": 9223372036854775807, "values": [1]}`, 400,
+			"Invalid memory range: 1 words from 9223372036854775807"},
+		{"GET", "/sessions/2/stack", "", 404, "Not found: GET /sessions/2/stack"},
+	}
+	apiCall(t, h, "POST", "/sessions", string(body))
+	for i, c := range errors {
+		code, result := apiCall(t, h, c.method, c.path, c.body)
+		if code != c.code || result["error"] != c.err {
+			t.Errorf("%d: Expected %d %q. Got %d %q.", i, c.code, c.err, code, result["error"])
+		}
+	}
+}
+
+func TestHTTPAPIPanic(t *testing.T) {
+	a := newAPIServer()
+	h := a.handler()
+	body, _ := json.Marshal(map[string]string{"program": "HALT 0,0,0\n"})
+	apiCall(t, h, "POST", "/sessions", string(body))
+
+	// A handler that panics mustn't leave the session locked.
+	func() {
+		defer func() { recover() }()
+		a.sessions["1"].call(func(s *apiSession, r *http.Request) (interface{}, error) {
+			panic("bad request")
+		}, nil)
+	}()
+
+	if code, _ := apiCall(t, h, "GET", "/sessions/1", ""); code != http.StatusOK {
+		t.Errorf("Expected the session to still answer. Got %d.", code)
+	}
+}
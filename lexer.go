@@ -0,0 +1,148 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// A token of a program line: a word, such as a mnemonic or number, or one
+// of the punctuation characters , ( and ).
+type lexToken struct {
+	text   string
+	column int // From 1
+}
+
+func isSpaceByte(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r'
+}
+
+func isPunct(c byte) bool {
+	return c == ',' || c == '(' || c == ')'
+}
+
+// Where the comment on a line starts, or the length of the line if it has
+// none. Comments start with ; or * and run to the end of the line.
+func commentStart(line string) int {
+	if i := strings.IndexAny(line, ";*"); i >= 0 {
+		return i
+	}
+	return len(line)
+}
+
+func withoutComment(line string) string {
+	return line[:commentStart(line)]
+}
+
+// Split a line into tokens, noting where each starts. Whitespace may
+// appear between any two tokens and is dropped, as is any comment.
+func lexLine(line string) []lexToken {
+	var tokens []lexToken
+	line = withoutComment(line)
+
+	for i := 0; i < len(line); {
+		j := i + 1
+
+		switch c := line[i]; {
+		case isSpaceByte(c):
+			i++
+			continue
+		case isPunct(c):
+		default:
+			for j < len(line) && !isSpaceByte(line[j]) && !isPunct(line[j]) {
+				j++
+			}
+		}
+
+		tokens = append(tokens, lexToken{line[i:j], i + 1})
+		i = j
+	}
+
+	return tokens
+}
+
+// Split a line into whitespace separated fields, as directives are,
+// noting where each starts. Any comment is dropped.
+func lexFields(line string) []lexToken {
+	var fields []lexToken
+	line = withoutComment(line)
+
+	for i := 0; i < len(line); {
+		if isSpaceByte(line[i]) {
+			i++
+			continue
+		}
+
+		j := i + 1
+		for j < len(line) && !isSpaceByte(line[j]) {
+			j++
+		}
+		fields = append(fields, lexToken{line[i:j], i + 1})
+		i = j
+	}
+
+	return fields
+}
+
+// The text of a line from the start of one token to the end of another.
+func tokenSpan(line string, first, last lexToken) lexToken {
+	return lexToken{line[first.column-1 : last.column-1+len(last.text)], first.column}
+}
+
+// Split a line holding an instruction into its mnemonic, in upper case,
+// and its operands. Errors are *ParseErrors.
+func splitInstruction(line string) (lexToken, lexToken, error) {
+	tokens := lexLine(line)
+	if len(tokens) == 0 {
+		return lexToken{}, lexToken{}, parseError(1, "", "Invalid instruction: ''")
+	}
+
+	all := tokenSpan(line, tokens[0], tokens[len(tokens)-1])
+	if len(tokens) < 2 || !unicode.IsLetter(rune(tokens[0].text[0])) {
+		return lexToken{}, lexToken{}, parseError(all.column, all.text, "Invalid instruction: '"+all.text+"'")
+	}
+
+	op := lexToken{strings.ToUpper(tokens[0].text), tokens[0].column}
+	return op, tokenSpan(line, tokens[1], tokens[len(tokens)-1]), nil
+}
+
+// Parse operands laid out as in format, which is made of the punctuation
+// expected and a letter for each number: r, s or t for a register, d for
+// any number and n for one that isn't negative. Errors are *ParseErrors,
+// with columns counted from the start of args.
+func parseFormat(format, args string) ([]int32, error) {
+	tokens := lexLine(args)
+	converted_args := make([]int32, 0, 3)
+
+	whole := strings.TrimSpace(args)
+	column := strings.Index(args, whole) + 1
+
+	if len(tokens) != len(format) {
+		return nil, parseError(column, whole, "Invalid arguments: "+args)
+	}
+	for i, tok := range tokens {
+		if isPunct(format[i]) != isPunct(tok.text[0]) || isPunct(format[i]) && tok.text != format[i:i+1] {
+			return nil, parseError(column, whole, "Invalid arguments: "+args)
+		}
+	}
+
+	for i, tok := range tokens {
+		if isPunct(format[i]) {
+			continue
+		}
+
+		num, err := strconv.ParseInt(tok.text, 10, 32)
+		if err != nil || format[i] == 'n' && num < 0 {
+			return nil, parseError(tok.column, tok.text, "Invalid arguments: "+args)
+		} else if strings.IndexByte("rst", format[i]) >= 0 && (num < 0 || num >= NUM_REGS) {
+			// Ensure that all register operands are valid registers
+			return nil, parseError(tok.column, tok.text, "Invalid arguments. Bad register: "+tok.text)
+		}
+		converted_args = append(converted_args, int32(num))
+	}
+
+	for len(converted_args) < 3 {
+		converted_args = append(converted_args, 0)
+	}
+	return converted_args, nil
+}
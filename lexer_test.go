@@ -0,0 +1,53 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLexLine(t *testing.T) {
+	cases := []struct {
+		in   string
+		want []lexToken
+	}{
+		{"", nil},
+		{"* Comment", nil},
+		{"  ; Comment", nil},
+		{"LD 1,2(3)", []lexToken{{"LD", 1}, {"1", 4}, {",", 5}, {"2", 6}, {"(", 7}, {"3", 8}, {")", 9}}},
+		{"\tadd\t1 , -2,3\r", []lexToken{{"add", 2}, {"1", 6}, {",", 8}, {"-2", 10}, {",", 12}, {"3", 13}}},
+		{"OUT 1,0,0 ; print * it", []lexToken{{"OUT", 1}, {"1", 5}, {",", 6}, {"0", 7}, {",", 8}, {"0", 9}}},
+		{"HALT*", []lexToken{{"HALT", 1}}},
+	}
+
+	for i, c := range cases {
+		if got := lexLine(c.in); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%d: lexLine(%q) == %v, want %v.", i, c.in, got, c.want)
+		}
+	}
+}
+
+func TestLoadCommentedProgram(t *testing.T) {
+	var tm TinyMachine
+	tm.stdout = &strings.Builder{}
+
+	prog := "; Add two numbers\n" +
+		"\tldc\t1, 2(0)\t; first\n" +
+		"  * Indented comment\n" +
+		".data 10 5 ; second\n" +
+		"\tLD 2, 10 (0) * load it\n" +
+		"\tadd 1, 1, 2\n" +
+		"\tout 1, 0, 0\n" +
+		"\thalt 0, 0, 0\n"
+	if err := tm.loadProgram("test", strings.NewReader(prog)); err != nil {
+		t.Fatalf("Unexpected error loading program: %s", err)
+	}
+	if !reflect.DeepEqual(tm.srclines, []int{2, 5, 6, 7, 8}) {
+		t.Errorf("Expected instructions on lines 2 and 5 to 8. Got %v.", tm.srclines)
+	}
+
+	tm.runProgram()
+	if tm.cpustate != cpuHALTED || tm.registers[1] != 7 {
+		t.Errorf("Expected the program to halt with r1 = 7. Got %v with r1 = %d.", tm.cpustate, tm.registers[1])
+	}
+}
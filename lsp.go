@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// An incoming language server protocol request or notification.
+// Notifications have no ID.
+type lspMessage struct {
+	ID     json.RawMessage `json:"id,omitempty"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params,omitempty"`
+}
+
+type lspPosition struct {
+	Line      int `json:"line"`
+	Character int `json:"character"`
+}
+
+type lspRange struct {
+	Start lspPosition `json:"start"`
+	End   lspPosition `json:"end"`
+}
+
+type lspDiagnostic struct {
+	Range    lspRange `json:"range"`
+	Severity int      `json:"severity"`
+	Source   string   `json:"source"`
+	Message  string   `json:"message"`
+}
+
+const lspError = 1 // Diagnostic severity
+
+// What the language server knows about one line of a program.
+type lspLine struct {
+	text string
+	addr int32          // Instruction address, or -1 if there's no instruction
+	diag *lspDiagnostic // Problem with the line, if any
+}
+
+// An lspServer checks .tm files as they're edited, and documents the
+// instruction set for the editor.
+type lspServer struct {
+	w    io.Writer
+	docs map[string][]lspLine // Analysis of each open document, by URI
+}
+
+// Serve the language server protocol on stdin and stdout.
+func serveLSP() error {
+	return newLSPServer(os.Stdout).serve(os.Stdin)
+}
+
+func newLSPServer(w io.Writer) *lspServer {
+	return &lspServer{w: w, docs: make(map[string][]lspLine)}
+}
+
+// Handle messages until the editor asks the server to exit.
+func (l *lspServer) serve(r io.Reader) error {
+	reader := bufio.NewReader(r)
+
+	for {
+		body, err := readFramed(reader)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		var msg lspMessage
+		if err := json.Unmarshal(body, &msg); err != nil {
+			return err
+		}
+		if msg.Method == "exit" {
+			return nil
+		}
+
+		result, ok := l.handle(msg)
+		if msg.ID == nil {
+			continue // Notifications get no response
+		}
+
+		resp := map[string]interface{}{"jsonrpc": "2.0", "id": msg.ID, "result": result}
+		if !ok {
+			delete(resp, "result")
+			resp["error"] = map[string]interface{}{"code": -32601, "message": "Method not found: " + msg.Method}
+		}
+		if err := writeFramed(l.w, resp); err != nil {
+			return err
+		}
+	}
+}
+
+// Respond to a message, returning false if the method isn't supported.
+func (l *lspServer) handle(msg lspMessage) (interface{}, bool) {
+	var params struct {
+		TextDocument struct {
+			URI  string `json:"uri"`
+			Text string `json:"text"`
+		} `json:"textDocument"`
+		ContentChanges []struct {
+			Text string `json:"text"`
+		} `json:"contentChanges"`
+		Position lspPosition `json:"position"`
+		Range    lspRange    `json:"range"`
+	}
+	json.Unmarshal(msg.Params, &params)
+	uri := params.TextDocument.URI
+
+	switch msg.Method {
+	case "initialize":
+		return map[string]interface{}{
+			"capabilities": map[string]interface{}{
+				"textDocumentSync":   1, // The full text on every change
+				"completionProvider": map[string]interface{}{},
+				"hoverProvider":      true,
+				"inlayHintProvider":  true,
+			},
+			"serverInfo": map[string]string{"name": "tinyvm"},
+		}, true
+	case "initialized":
+		return nil, true
+	case "shutdown":
+		return nil, true
+	case "textDocument/didOpen":
+		l.update(uri, params.TextDocument.Text)
+		return nil, true
+	case "textDocument/didChange":
+		if n := len(params.ContentChanges); n > 0 {
+			l.update(uri, params.ContentChanges[n-1].Text)
+		}
+		return nil, true
+	case "textDocument/didClose":
+		delete(l.docs, uri)
+		l.notify("textDocument/publishDiagnostics",
+			map[string]interface{}{"uri": uri, "diagnostics": []lspDiagnostic{}})
+		return nil, true
+	case "textDocument/completion":
+		return completions(), true
+	case "textDocument/hover":
+		return l.hover(uri, params.Position), true
+	case "textDocument/inlayHint":
+		return l.inlayHints(uri, params.Range), true
+	}
+
+	return nil, msg.ID == nil
+}
+
+func (l *lspServer) notify(method string, params interface{}) {
+	writeFramed(l.w, map[string]interface{}{"jsonrpc": "2.0", "method": method, "params": params})
+}
+
+// Check a new version of a document and publish its problems.
+func (l *lspServer) update(uri, text string) {
+	lines := analyzeSource(text)
+	l.docs[uri] = lines
+
+	diags := []lspDiagnostic{}
+	for _, line := range lines {
+		if line.diag != nil {
+			diags = append(diags, *line.diag)
+		}
+	}
+
+	l.notify("textDocument/publishDiagnostics", map[string]interface{}{"uri": uri, "diagnostics": diags})
+}
+
+// Work out the address of each instruction and find any lines that
+// wouldn't load. Every instruction line takes an address, even if it's
+// invalid, so that addresses don't shift while the line is being fixed.
+func analyzeSource(source string) []lspLine {
+	var tm TinyMachine
+	tm.stdout = io.Discard
+	tm.initializeMachine(true)
+
+	var lines []lspLine
+	addr := int32(0)
+
+	for n, text := range strings.Split(source, "\n") {
+		text = strings.TrimSuffix(text, "\r")
+		line := lspLine{text: text, addr: -1}
+
+		if isCommentLine(text) {
+			// Nothing to check
+		} else if strings.HasPrefix(strings.TrimSpace(text), ".") {
+			if err := tm.loadDirective(text); err != nil {
+				perr := err.(*ParseError)
+				line.diag = tokenDiagnostic(n, perr.Column, perr.Token, err.Error())
+			}
+		} else {
+			line.addr, addr = addr, addr+1
+			line.diag = instructionDiagnostic(n, text)
+		}
+
+		lines = append(lines, line)
+	}
+
+	return lines
+}
+
+// Diagnose the problem, if any, with an instruction, pointing at the
+// opcode or operands when they're to blame.
+func instructionDiagnostic(n int, text string) *lspDiagnostic {
+	_, err := parseInstruction(text)
+	if err == nil {
+		return nil
+	}
+
+	mnemonic, operands, serr := splitInstruction(text)
+	opnum, ok := opcodeNumbers[mnemonic.text]
+	if serr != nil || !ok {
+		perr := err.(*ParseError)
+		return tokenDiagnostic(n, perr.Column, perr.Token, err.Error())
+	}
+
+	op := opcodes[opnum]
+	if _, operr := parseOperands(op.ioptype, operands.text); operr != nil {
+		err = operr
+	}
+	m := fmt.Sprintf("%s. Expected %s %s", err, op.name, operandFormat(op.ioptype))
+	return tokenDiagnostic(n, operands.column, operands.text, m)
+}
+
+// A diagnostic covering a token starting at a column, from 1, of line n.
+func tokenDiagnostic(n, column int, token, message string) *lspDiagnostic {
+	start := column - 1
+	return &lspDiagnostic{
+		Range:    lspRange{lspPosition{n, start}, lspPosition{n, start + len(token)}},
+		Severity: lspError,
+		Source:   "tinyvm",
+		Message:  message,
+	}
+}
+
+// Describe an opcode for completion and hover.
+func opcodeDoc(opnum int32) string {
+	op := opcodes[opnum]
+	doc := op.doc
+	if op.privileged {
+		doc += " Privileged, so faults in user mode."
+	}
+	return doc
+}
+
+func completions() []map[string]interface{} {
+	items := make([]map[string]interface{}, len(opcodes))
+	for i, op := range opcodes {
+		items[i] = map[string]interface{}{
+			"label":         op.name,
+			"kind":          14, // Keyword
+			"detail":        op.name + " " + operandFormat(op.ioptype),
+			"documentation": opcodeDoc(int32(i)),
+		}
+	}
+	return items
+}
+
+// Document the opcode under the cursor, and the address of its line.
+func (l *lspServer) hover(uri string, pos lspPosition) interface{} {
+	lines := l.docs[uri]
+	if pos.Line < 0 || pos.Line >= len(lines) || lines[pos.Line].addr < 0 {
+		return nil
+	}
+
+	line := lines[pos.Line]
+	start, end := pos.Character, pos.Character
+	for start > 0 && start <= len(line.text) && isWordByte(line.text[start-1]) {
+		start--
+	}
+	for end < len(line.text) && isWordByte(line.text[end]) {
+		end++
+	}
+
+	var doc string
+	if start < end {
+		if opnum, ok := opcodeNumbers[strings.ToUpper(line.text[start:end])]; ok {
+			doc = fmt.Sprintf("```\n%s %s\n```\n%s\n\n",
+				opcodes[opnum].name, operandFormat(opcodes[opnum].ioptype), opcodeDoc(opnum))
+		}
+	}
+	doc += fmt.Sprintf("Instruction address %d", line.addr)
+
+	return map[string]interface{}{"contents": map[string]string{"kind": "markdown", "value": doc}}
+}
+
+func isWordByte(b byte) bool {
+	return b >= 'A' && b <= 'Z' || b >= 'a' && b <= 'z' || b >= '0' && b <= '9'
+}
+
+// Show the address of each instruction at the end of its line.
+func (l *lspServer) inlayHints(uri string, r lspRange) []map[string]interface{} {
+	hints := []map[string]interface{}{}
+
+	for n, line := range l.docs[uri] {
+		if line.addr < 0 || n < r.Start.Line || n > r.End.Line {
+			continue
+		}
+		hints = append(hints, map[string]interface{}{
+			"position":    lspPosition{n, len(line.text)},
+			"label":       fmt.Sprintf("@%d", line.addr),
+			"paddingLeft": true,
+		})
+	}
+
+	return hints
+}
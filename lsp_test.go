@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestAnalyzeSource(t *testing.T) {
+	source := "* Comment\nLDC 1,5(0)\n\nFOO 1,2,3\n.protect 1 2 xx\nADD 1,2,9\nLD 1,2\nOUT 1,0,0\r\n"
+
+	expected := []struct {
+		addr    int32
+		message string
+		start   int
+		end     int
+	}{
+		{-1, "", 0, 0},
+		{0, "", 0, 0},
+		{-1, "", 0, 0},
+		{1, "Invalid opcode: 'FOO'", 0, 3},
+		{-1, "Invalid protection: 'xx'", 13, 15},
+		{2, "Invalid arguments. Bad register: 9. Expected ADD r,s,t", 4, 9},
+		{3, "Invalid arguments: 1,2. Expected LD r,d(s)", 3, 6},
+		{4, "", 0, 0},
+		{-1, "", 0, 0},
+	}
+
+	lines := analyzeSource(source)
+	if len(lines) != len(expected) {
+		t.Fatalf("Expected %d lines. Got %d.", len(expected), len(lines))
+	}
+	for i, want := range expected {
+		line := lines[i]
+		if line.addr != want.addr {
+			t.Errorf("%d: Expected address %d. Got %d.", i, want.addr, line.addr)
+		}
+		if want.message == "" {
+			if line.diag != nil {
+				t.Errorf("%d: Unexpected diagnostic: %s", i, line.diag.Message)
+			}
+			continue
+		}
+		if line.diag == nil {
+			t.Errorf("%d: Expected diagnostic %q.", i, want.message)
+		} else if d := line.diag; d.Message != want.message || d.Range.Start != (lspPosition{i, want.start}) ||
+			d.Range.End != (lspPosition{i, want.end}) {
+			t.Errorf("%d: Expected %q at %d-%d. Got %q at %v.", i, want.message, want.start, want.end, d.Message, d.Range)
+		}
+	}
+}
+
+func TestLSPSession(t *testing.T) {
+	var in, out bytes.Buffer
+	requests := []map[string]interface{}{
+		{"id": 1, "method": "initialize", "params": map[string]interface{}{}},
+		{"method": "initialized", "params": map[string]interface{}{}},
+		{"method": "textDocument/didOpen", "params": map[string]interface{}{
+			"textDocument": map[string]string{"uri": "file:///a.tm", "text": "* Start\nLDA 1,1(1)\nJMP 0,0(0)\n"},
+		}},
+		{"id": 2, "method": "textDocument/hover", "params": map[string]interface{}{
+			"textDocument": map[string]string{"uri": "file:///a.tm"},
+			"position":     lspPosition{1, 1},
+		}},
+		{"id": 3, "method": "textDocument/completion", "params": map[string]interface{}{}},
+		{"id": 4, "method": "textDocument/inlayHint", "params": map[string]interface{}{
+			"textDocument": map[string]string{"uri": "file:///a.tm"},
+			"range":        lspRange{lspPosition{0, 0}, lspPosition{10, 0}},
+		}},
+		{"id": 5, "method": "textDocument/definition", "params": map[string]interface{}{}},
+		{"id": 6, "method": "shutdown"},
+		{"method": "exit"},
+	}
+	for _, req := range requests {
+		req["jsonrpc"] = "2.0"
+		writeFramed(&in, req)
+	}
+
+	if err := newLSPServer(&out).serve(&in); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	reader := bufio.NewReader(&out)
+	var msgs []map[string]interface{}
+	for {
+		body, err := readFramed(reader)
+		if err != nil {
+			break
+		}
+		var msg map[string]interface{}
+		json.Unmarshal(body, &msg)
+		msgs = append(msgs, msg)
+	}
+
+	if len(msgs) != 7 {
+		t.Fatalf("Expected 7 messages. Got %d: %v", len(msgs), msgs)
+	}
+
+	diags := msgs[1]["params"].(map[string]interface{})["diagnostics"].([]interface{})
+	if len(diags) != 1 || diags[0].(map[string]interface{})["message"] != "Invalid opcode: 'JMP'" {
+		t.Errorf("Expected a diagnostic for JMP. Got %v.", diags)
+	}
+
+	hover := msgs[2]["result"].(map[string]interface{})["contents"].(map[string]interface{})["value"].(string)
+	if !strings.Contains(hover, "LDA r,d(s)") || !strings.Contains(hover, "reg[r] = d + reg[s].") ||
+		!strings.HasSuffix(hover, "Instruction address 0") {
+		t.Errorf("Expected hover to document LDA at address 0. Got %q.", hover)
+	}
+
+	items := msgs[3]["result"].([]interface{})
+	if len(items) != len(opcodes) || items[0].(map[string]interface{})["detail"] != "HALT r,s,t" {
+		t.Errorf("Expected a completion for each opcode. Got %v.", items)
+	}
+
+	hints := msgs[4]["result"].([]interface{})
+	if len(hints) != 2 || hints[1].(map[string]interface{})["label"] != "@1" {
+		t.Errorf("Expected address hints for both instructions. Got %v.", hints)
+	}
+
+	if _, ok := msgs[5]["error"]; !ok {
+		t.Errorf("Expected an error for an unsupported method. Got %v.", msgs[5])
+	}
+	if result, ok := msgs[6]["result"]; !ok || result != nil {
+		t.Errorf("Expected a null result for shutdown. Got %v.", msgs[6])
+	}
+}
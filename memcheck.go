@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+)
+
+// Memory checking catches programs reading data memory they never wrote,
+// which zero filling would otherwise hide. A cell counts as written once
+// something stores to it, or if it was set up when the machine was reset:
+// the memory size in address 0, the program image in unified mode, and
+// cells given by .data directives.
+func (tm *TinyMachine) resetMemcheck() {
+	if !*memcheck {
+		tm.initialized = nil
+		return
+	}
+
+	if len(tm.initialized) != int(tm.mem_size) {
+		tm.initialized = make([]bool, tm.mem_size)
+	} else {
+		// Cores sharing memory share this too.
+		clear(tm.initialized)
+	}
+
+	if tm.unified {
+		for addr := range tm.image {
+			tm.markInitialized(int32(addr))
+		}
+	} else {
+		tm.markInitialized(0)
+	}
+	for addr := range tm.initdata {
+		tm.markInitialized(addr)
+	}
+}
+
+func (tm *TinyMachine) markInitialized(addr int32) {
+	if tm.initialized != nil {
+		tm.initialized[addr] = true
+	}
+}
+
+// Report a read of a cell that hasn't been written, given the address the
+// program used and the physical address it refers to.
+func (tm *TinyMachine) checkRead(pc, addr, pa int32) {
+	if tm.initialized != nil && !tm.initialized[pa] {
+		tm.speak(fmt.Sprintf("Read of uninitialized memory at address %d (PC %d).", addr, pc))
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestMemcheck(t *testing.T) {
+	*memcheck = true
+	defer func() { *memcheck = false }()
+
+	// Reads the memory size, a .data cell, a cell it stored to, one it
+	// didn't, and then one through FAA.
+	prog := ".data 40 7 8\nLD 1,0(0)\nLD 2,41(0)\nST 2,50(0)\nLD 3,50(0)\nLD 4,51(0)\nLDC 5,52(0)\nFAA 1,0(5)\nHALT 0,0,0\n"
+
+	for _, unified := range []bool{false, true} {
+		var tm TinyMachine
+		var out bytes.Buffer
+
+		tm.unified = unified
+		if err := tm.loadProgram("test", strings.NewReader(prog)); err != nil {
+			t.Fatalf("%t: Unexpected error loading program.", unified)
+		}
+		tm.stdout = &out
+
+		// Running twice checks that a reset forgets the writes.
+		for i := 0; i < 2; i++ {
+			out.Reset()
+			tm.runProgram()
+			if tm.registers[2] != 8 {
+				t.Errorf("%t: Expected .data to set memory. Got %d.", unified, tm.registers[2])
+			}
+
+			want := "Read of uninitialized memory at address 51 (PC 4).\nRead of uninitialized memory at address 52 (PC 6).\nProgram halted.\n"
+			if out.String() != want {
+				t.Errorf("%t, %d: Expected %q. Got %q.", unified, i, want, out.String())
+			}
+			tm.resetState()
+		}
+
+		// In unified mode the program is in memory, and so initialized.
+		out.Reset()
+		runInstruction(t, &tm, "LD 6,1(0)")
+		if got := out.String(); unified != !strings.Contains(got, "uninitialized") {
+			t.Errorf("%t: Unexpected report reading address 1: %q.", unified, got)
+		}
+	}
+}
+
+// Replace the first instruction and run it.
+func runInstruction(t *testing.T, tm *TinyMachine, instruction string) {
+	if err := tm.command(tm.menu(), "asm 0 "+instruction); err != nil {
+		t.Fatal(err)
+	}
+	tm.registers[PC_REG] = 0
+	tm.stepProgram()
+}
+
+func TestMemcheckSyscall(t *testing.T) {
+	*memcheck = true
+	defer func() { *memcheck = false }()
+
+	var tm TinyMachine
+	var out bytes.Buffer
+	if err := tm.loadProgram("test", strings.NewReader("SYS 1\nLD 1,60(0)\nHALT 0,0,0\n")); err != nil {
+		t.Fatalf("Unexpected error loading program.")
+	}
+	tm.stdout = &out
+	tm.RegisterSyscall(1, func(tm *TinyMachine) error {
+		return tm.WriteMemory(60, 0)
+	})
+
+	tm.runProgram()
+	if out.String() != "Program halted.\n" {
+		t.Errorf("Expected memory written by the system call to be initialized. Got %q.", out.String())
+	}
+
+	out.Reset()
+	tm.command(tm.menu(), "who 60")
+	if want := "mem[60] = 0\n  0 written at step 1 by 0000: SYS  1 (system call)\n"; out.String() != want {
+		t.Errorf("Expected %q. Got %q.", want, out.String())
+	}
+}
+
+func TestDataDirective(t *testing.T) {
+	cases := []struct {
+		line     string
+		want_err string
+	}{
+		{".data 10", "Invalid directive: '.data 10'"},
+		{".data x 1", "Invalid address: 'x'"},
+		{".data 1023 1 2", "Data doesn't fit in memory: '.data 1023 1 2'"},
+		{".data -1 1", "Data doesn't fit in memory: '.data -1 1'"},
+		{".data 5 1 y", "Invalid value: 'y'"},
+	}
+
+	for i, c := range cases {
+		var tm TinyMachine
+		tm.stdout = &bytes.Buffer{}
+		tm.initializeMachine(true)
+
+		err := tm.loadDirective(c.line)
+		if err == nil || err.Error() != c.want_err {
+			t.Errorf("%d: Expected error %q. Got %v.", i, c.want_err, err)
+		}
+	}
+}
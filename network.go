@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// A channel carries words from a SEND port on one machine to a RECV port
+// on another. SEND blocks while the channel is full and RECV while it's
+// empty.
+type channel struct {
+	buf      []int32
+	capacity int
+}
+
+// Split a port reference of the form machine:port.
+func parsePortRef(ref string) (string, int32, error) {
+	i := strings.LastIndex(ref, ":")
+	if i < 1 {
+		return "", 0, errors.New("Invalid port: '" + ref + "'")
+	}
+
+	port, err := strconv.ParseInt(ref[i+1:], 10, 32)
+	if err != nil {
+		return "", 0, errors.New("Invalid port: '" + ref + "'")
+	}
+
+	return ref[:i], int32(port), nil
+}
+
+// Connect a SEND port on one machine to a RECV port on another, both
+// given as machine:port. Each port can only be connected once.
+func (s *Scheduler) Connect(from, to string, capacity int) error {
+	var sender, receiver *TinyMachine
+
+	fname, fport, err := parsePortRef(from)
+	if err != nil {
+		return err
+	}
+	tname, tport, err := parsePortRef(to)
+	if err != nil {
+		return err
+	}
+
+	for _, p := range s.procs {
+		if p.name == fname {
+			sender = p.tm
+		}
+		if p.name == tname {
+			receiver = p.tm
+		}
+	}
+
+	if sender == nil {
+		return errors.New("Unknown machine: '" + fname + "'")
+	} else if receiver == nil {
+		return errors.New("Unknown machine: '" + tname + "'")
+	} else if _, ok := sender.outports[fport]; ok {
+		return errors.New("Port already connected: '" + from + "'")
+	} else if _, ok := receiver.inports[tport]; ok {
+		return errors.New("Port already connected: '" + to + "'")
+	} else if capacity < 1 {
+		return fmt.Errorf("Invalid channel capacity: %d", capacity)
+	}
+
+	ch := &channel{nil, capacity}
+	if sender.outports == nil {
+		sender.outports = make(map[int32]*channel)
+	}
+	if receiver.inports == nil {
+		receiver.inports = make(map[int32]*channel)
+	}
+	sender.outports[fport] = ch
+	receiver.inports[tport] = ch
+
+	return nil
+}
+
+// Build a network of machines from a topology description. Each line is
+// blank, a comment starting with *, or one of:
+//
+//	machine name program.tm
+//	connect name:port name:port [capacity]
+//
+// Program paths are relative to dir. Connections run from a SEND port to
+// a RECV port and hold one word unless a capacity is given.
+func LoadTopology(fh io.Reader, dir string) (*Scheduler, error) {
+	s := NewScheduler(0, 1, schedRoundRobin)
+	s.unified = *unified
+	scanner := bufio.NewScanner(fh)
+	linenum := 0
+
+	for scanner.Scan() {
+		linenum++
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "*") {
+			continue
+		}
+
+		var err error
+		switch {
+		case fields[0] == "machine" && len(fields) == 3:
+			path := fields[2]
+			if !filepath.IsAbs(path) {
+				path = filepath.Join(dir, path)
+			}
+			err = s.loadNetworkMachine(fields[1], path)
+		case fields[0] == "connect" && (len(fields) == 3 || len(fields) == 4):
+			capacity := 1
+			if len(fields) == 4 {
+				capacity, err = strconv.Atoi(fields[3])
+				if err != nil {
+					err = errors.New("Invalid channel capacity: '" + fields[3] + "'")
+					break
+				}
+			}
+			err = s.Connect(fields[1], fields[2], capacity)
+		default:
+			err = errors.New("Invalid topology entry: '" + strings.Join(fields, " ") + "'")
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("Error in topology at line %d: %s", linenum, err)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(s.procs) == 0 {
+		return nil, errors.New("The topology doesn't describe any machines.")
+	}
+
+	return s, nil
+}
+
+func (s *Scheduler) loadNetworkMachine(name, path string) error {
+	for _, p := range s.procs {
+		if p.name == name {
+			return errors.New("Duplicate machine: '" + name + "'")
+		}
+	}
+
+	programfile, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer programfile.Close()
+
+	tm, err := s.LoadMachine(path, programfile)
+	if err == nil {
+		// Name the process after the machine rather than its program.
+		s.procs[tm.coreid].name = name
+	}
+	return err
+}
+
+// Load the network described by the named topology file and start the REPL.
+func runNetwork(name string) {
+	topofile, err := os.Open(name)
+	if err != nil {
+		log.Fatalf("Error reading from %s: %s\n", name, err)
+	}
+	defer topofile.Close()
+
+	sched, err := LoadTopology(topofile, filepath.Dir(name))
+	if err != nil {
+		log.Fatal(err)
+	}
+	sched.quantum, sched.policy = schedulerFlags()
+	sched.Seed(*seed)
+
+	sched.procs[0].tm.Interact()
+}
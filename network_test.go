@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func loadNetwork(t *testing.T, progs map[string]string, names ...string) *Scheduler {
+	s := NewScheduler(0, 1, schedRoundRobin)
+	for _, name := range names {
+		if _, err := s.LoadMachine(name, bytes.NewBufferString(progs[name])); err != nil {
+			t.Fatalf("Unexpected error loading %s: %s", name, err)
+		}
+	}
+
+	return s
+}
+
+func TestSENDRECVInstructions(t *testing.T) {
+	s := loadNetwork(t, map[string]string{
+		"a": "LDC 1,7(0)\nSEND 1,0(0)\nSEND 1,0(0)\nSEND 1,1(0)\n",
+		"b": "RECV 2,3(0)\nRECV 2,4(0)\n",
+	}, "a", "b")
+	if err := s.Connect("a:0", "b:3", 1); err != nil {
+		t.Fatalf("Unexpected error connecting ports: %s", err)
+	}
+
+	a, b := s.procs[0].tm, s.procs[1].tm
+
+	// Nothing to receive yet.
+	b.stepProgram()
+	if !b.blocked || b.registers[PC_REG] != 0 {
+		t.Errorf("Expected RECV to block at PC 0. Got blocked %t at PC %d.", b.blocked, b.registers[PC_REG])
+	}
+
+	a.stepProgram()
+	a.stepProgram()
+	a.stepProgram()
+	if !a.blocked || a.registers[PC_REG] != 2 {
+		t.Errorf("Expected second SEND to block at PC 2. Got blocked %t at PC %d.", a.blocked, a.registers[PC_REG])
+	}
+
+	b.stepProgram()
+	if b.blocked || b.registers[2] != 7 {
+		t.Errorf("Expected RECV to get 7. Got blocked %t with %d.", b.blocked, b.registers[2])
+	}
+
+	a.stepProgram()
+	if a.blocked || a.registers[PC_REG] != 3 {
+		t.Errorf("Expected SEND to complete once there was room. Got blocked %t at PC %d.",
+			a.blocked, a.registers[PC_REG])
+	}
+
+	// Neither port is connected.
+	for _, tm := range []*TinyMachine{a, b} {
+		tm.stepProgram()
+		if tm.cpustate != cpuPORT_ERR {
+			t.Errorf("Expected cpu state to be %d. Got %d.", cpuPORT_ERR, tm.cpustate)
+		}
+	}
+}
+
+func TestNetworkDeadlock(t *testing.T) {
+	// Each machine waits to hear from the other before sending.
+	progs := map[string]string{
+		"a": "RECV 1,0(0)\nSEND 1,0(0)\n",
+		"b": "RECV 1,0(0)\nSEND 1,0(0)\n",
+	}
+
+	s := loadNetwork(t, progs, "a", "b")
+	s.Connect("a:0", "b:0", 1)
+	s.Connect("b:0", "a:0", 1)
+
+	steps := 0
+	for s.step() {
+		steps++
+		if steps > 100 {
+			t.Fatalf("Expected deadlock to stop the network.")
+		}
+	}
+	if !s.deadlocked() {
+		t.Errorf("Expected network to be deadlocked.")
+	}
+	for i, p := range s.procs {
+		if p.tm.cpustate != cpuOK || !p.tm.blocked || p.tm.blockedop != "RECV" {
+			t.Errorf("%d: Expected machine to be blocked on RECV. Got state %d, blocked %t on %q.",
+				i, p.tm.cpustate, p.tm.blocked, p.tm.blockedop)
+		}
+	}
+
+	// A machine that halts leaves its partner waiting forever.
+	progs["a"] = "HALT 0,0,0\n"
+	s = loadNetwork(t, progs, "a", "b")
+	s.Connect("a:0", "b:0", 1)
+	var out bytes.Buffer
+	s.procs[0].tm.stdout = &out
+	s.run()
+	if !s.deadlocked() || s.procs[0].tm.cpustate != cpuHALTED {
+		t.Errorf("Expected b to be deadlocked once a halted.")
+	}
+	if want := "Deadlock: every running process is blocked.\n"; !strings.HasSuffix(out.String(), want) {
+		t.Errorf("Expected %q from the inspected process. Got %q.", want, out.String())
+	}
+
+	out.Reset()
+	s.listProcesses()
+	if !strings.Contains(out.String(), "blocked on RECV port 0") {
+		t.Errorf("Expected the process list to show b blocked. Got %q.", out.String())
+	}
+}
+
+func TestLoadTopology(t *testing.T) {
+	dir := t.TempDir()
+	progs := map[string]string{
+		"producer.tm": "LDC 1,3(0)\nLDC 2,1(0)\nSEND 1,0(0)\nSUB 1,1,2\nJGE 1,-3(7)\nHALT 0,0,0\n",
+		"summer.tm":   "RECV 1,0(0)\nADD 2,2,1\nJNE 1,-3(7)\nST 2,1(0)\nHALT 0,0,0\n",
+	}
+	for name, prog := range progs {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(prog), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	topo := "* A comment\nmachine gen producer.tm\n\nmachine sum summer.tm\nconnect gen:0 sum:0 2\n"
+	s, err := LoadTopology(strings.NewReader(topo), dir)
+	if err != nil {
+		t.Fatalf("Unexpected error loading topology: %s", err)
+	}
+
+	s.run()
+	if s.procs[1].name != "sum" || s.procs[1].tm.data_memory[1] != 6 {
+		t.Errorf("Expected sum to total 6. Got %d.", s.procs[1].tm.data_memory[1])
+	}
+	if s.deadlocked() {
+		t.Errorf("Expected network to finish without deadlock.")
+	}
+
+	cases := []struct {
+		topo     string
+		want_err string
+	}{
+		{"", "The topology doesn't describe any machines."},
+		{"machine gen\n", "Error in topology at line 1: Invalid topology entry: 'machine gen'"},
+		{"machine gen producer.tm\nmachine gen summer.tm\n",
+			"Error in topology at line 2: Duplicate machine: 'gen'"},
+		{"machine gen producer.tm\nconnect gen:0 sum:0\n",
+			"Error in topology at line 2: Unknown machine: 'sum'"},
+		{"machine gen producer.tm\nconnect gen:0 gen:x\n",
+			"Error in topology at line 2: Invalid port: 'gen:x'"},
+		{"machine gen producer.tm\nconnect gen:0 gen:0 0\n",
+			"Error in topology at line 2: Invalid channel capacity: 0"},
+		{"machine gen producer.tm\nconnect gen:0 gen:0\nconnect gen:0 gen:1\n",
+			"Error in topology at line 3: Port already connected: 'gen:0'"},
+	}
+	for i, c := range cases {
+		_, err := LoadTopology(strings.NewReader(c.topo), dir)
+		if err == nil {
+			t.Errorf("%d: Expected error loading topology %q.", i, c.topo)
+		} else if err.Error() != c.want_err {
+			t.Errorf("%d: Expected error '%q' but got '%q'.", i, c.want_err, err.Error())
+		}
+	}
+}
+
+func TestNetworkPriority(t *testing.T) {
+	// The receiver outranks the sender, which has to run for it to get
+	// anything.
+	s := loadNetwork(t, map[string]string{
+		"recv": ".priority 5\nRECV 1,0(0)\nRECV 2,0(0)\nADD 1,1,2\nHALT 0,0,0\n",
+		"send": ".priority 1\nLDC 1,3(0)\nSEND 1,0(0)\nLDC 1,4(0)\nSEND 1,0(0)\nHALT 0,0,0\n",
+	}, "recv", "send")
+	s.policy = schedPriority
+	if err := s.Connect("send:0", "recv:0", 1); err != nil {
+		t.Fatalf("Unexpected error connecting ports: %s", err)
+	}
+
+	steps := 0
+	for s.step() {
+		steps++
+		if steps > 100 {
+			t.Fatalf("Expected the network to finish. The sender ran %d steps.", s.procs[1].steps)
+		}
+	}
+
+	for i, p := range s.procs {
+		if p.tm.cpustate != cpuHALTED {
+			t.Errorf("%d: Expected %s to halt. Got %v.", i, p.name, p.tm.cpustate)
+		}
+	}
+	if r1 := s.procs[0].tm.registers[1]; r1 != 7 {
+		t.Errorf("Expected the receiver to add up to 7. Got %d.", r1)
+	}
+}
@@ -0,0 +1,7 @@
+* Send the numbers 5 down to 1 on port 0, followed by 0 to mark the end.
+LDC  1,5(0)
+LDC  2,1(0)
+SEND 1,0(0)
+SUB  1,1,2
+JGE  1,-3(7)
+HALT 0,0,0
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// A writeRecord notes which instruction wrote a register or memory cell.
+// The zero value means it hasn't been written.
+type writeRecord struct {
+	step  int    // Value of steps when it was written
+	pc    int32  // Address of the instruction that wrote it
+	value int32  // The value written
+	cause string // What wrote it, if not the instruction itself
+}
+
+// The provenance of the machine's state: the last write to each register
+// and memory cell since the last reset, and optionally every write. The PC
+// is only counted as written when it doesn't simply move on to the next
+// instruction.
+type provenance struct {
+	registers  [NUM_REGS]writeRecord
+	memory     []writeRecord // By physical address
+	keep       bool          // Keep every write, not just the last
+	reghistory [NUM_REGS][]writeRecord
+	memhistory map[int32][]writeRecord
+}
+
+func (p *provenance) reset(mem_size int32, keep bool) {
+	memory, memhistory := p.memory, p.memhistory
+	*p = provenance{keep: keep}
+
+	// Cores sharing memory share these too, so they're cleared in place.
+	if len(memory) != int(mem_size) {
+		memory = make([]writeRecord, mem_size)
+	} else {
+		clear(memory)
+	}
+	if !keep {
+		memhistory = nil
+	} else if memhistory == nil {
+		memhistory = make(map[int32][]writeRecord)
+	} else {
+		clear(memhistory)
+	}
+	p.memory, p.memhistory = memory, memhistory
+}
+
+func (tm *TinyMachine) noteRegisterWrite(r, pc int32, cause string) {
+	w := writeRecord{tm.steps, pc, tm.registers[r], cause}
+	tm.writes.registers[r] = w
+	if tm.writes.keep {
+		tm.writes.reghistory[r] = append(tm.writes.reghistory[r], w)
+	}
+}
+
+func (tm *TinyMachine) noteMemoryWrite(addr, pc int32, cause string) {
+	if addr < 0 || int(addr) >= len(tm.writes.memory) {
+		return
+	}
+
+	tm.markInitialized(addr)
+
+	w := writeRecord{tm.steps, pc, tm.data_memory[addr], cause}
+	tm.writes.memory[addr] = w
+	if tm.writes.keep {
+		tm.writes.memhistory[addr] = append(tm.writes.memhistory[addr], w)
+	}
+}
+
+// Note the writes made by an instruction that completed, including the
+// memory cell it wrote, if any.
+func (tm *TinyMachine) noteInstructionWrites(pc int32, ti TinyInstruction, written int32) {
+	if r := ti.iargs[0]; writesRegister[ti.iop] && r != PC_REG {
+		tm.noteRegisterWrite(r, pc, "")
+	}
+	if written >= 0 {
+		tm.noteMemoryWrite(written, pc, "")
+	}
+}
+
+// Describe a write, showing the instruction that made it as it is now.
+func (tm *TinyMachine) describeWrite(w writeRecord) string {
+	if w == (writeRecord{}) {
+		return "not written since reset"
+	} else if w.cause == "edit" {
+		return fmt.Sprintf("%d written from the REPL after step %d", w.value, w.step)
+	}
+
+	by := fmt.Sprintf("%04d", w.pc)
+	if ti, ok := tm.instructionAt(w.pc); ok {
+		by += fmt.Sprintf(": %v", ti)
+	}
+	if w.cause != "" {
+		by += " (" + w.cause + ")"
+	}
+	return fmt.Sprintf("%d written at step %d by %s", w.value, w.step, by)
+}
+
+// Show who wrote a register, given as r0 to r7 or pc, or a physical data
+// memory address, listing every write if they're being kept.
+func handleWho(tm *TinyMachine, args []string) error {
+	if len(args) != 1 {
+		return errors.New("Usage: who r|addr")
+	}
+
+	var name string
+	var last writeRecord
+	var history []writeRecord
+
+	if n, ok := strings.CutPrefix(args[0], "r"); ok || args[0] == "pc" {
+		r, err := strconv.Atoi(n)
+		if args[0] == "pc" {
+			r, err = PC_REG, nil
+		}
+		if err != nil || r < 0 || r >= NUM_REGS {
+			return errors.New("Invalid register: '" + args[0] + "'")
+		}
+		name = fmt.Sprintf("%s = %d", args[0], tm.registers[r])
+		last, history = tm.writes.registers[r], tm.writes.reghistory[r]
+	} else {
+		addr, err := tm.argNumber(args, 0, "", 0)
+		if err != nil {
+			return err
+		} else if addr < 0 || addr >= tm.mem_size {
+			return errors.New("Invalid address.")
+		}
+		name = fmt.Sprintf("mem[%d] = %d", addr, tm.data_memory[addr])
+		last, history = tm.writes.memory[addr], tm.writes.memhistory[addr]
+	}
+
+	tm.speak(name)
+	if !tm.writes.keep || last == (writeRecord{}) {
+		history = []writeRecord{last}
+	}
+	for _, w := range history {
+		tm.speak("  " + tm.describeWrite(w))
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestWho(t *testing.T) {
+	var tm TinyMachine
+	var out bytes.Buffer
+
+	// Store 1, 2 and 3 to mem[20], then divide by zero into a trap handler.
+	prog := "LDC 6,30(0)\nTVEC 6,10(0)\nLDC 2,20(0)\nLDA 1,1(1)\nST 1,0(2)\nLDC 3,3(0)\nSUB 3,3,1\nJGT 3,-5(7)\nDIV 4,1,0\nHALT 0,0,0\nHALT 0,0,0\n"
+	if err := tm.loadProgram("test", strings.NewReader(prog)); err != nil {
+		t.Fatalf("Unexpected error loading program.")
+	}
+	tm.stdout = &out
+	menu := tm.menu()
+	tm.command(menu, "g")
+
+	cases := []struct {
+		line string
+		want string
+	}{
+		{"who 20", "mem[20] = 3\n  3 written at step 15 by 0004: ST   1,0(2)\n"},
+		{"who r1", "r1 = 3\n  3 written at step 14 by 0003: LDA  1,1(1)\n"},
+		{"who r4", "r4 = 0\n  not written since reset\n"},
+		{"who pc", "pc = 11\n  10 written at step 19 by 0008: DIV  4,1,0\n"},
+		{"who 30", "mem[30] = 8\n  8 written at step 19 by 0008: DIV  4,1,0 (trap)\n"},
+		{"who 21", "mem[21] = 0\n  not written since reset\n"},
+	}
+	for i, c := range cases {
+		out.Reset()
+		if err := tm.command(menu, c.line); err != nil {
+			t.Errorf("%d: Unexpected error from %q: %s", i, c.line, err)
+		} else if out.String() != c.want {
+			t.Errorf("%d: Expected %q. Got %q.", i, c.want, out.String())
+		}
+	}
+
+	out.Reset()
+	tm.command(menu, "setm 21 5")
+	tm.command(menu, "who 21")
+	if want := "mem[21] = 5\n  5 written from the REPL after step 20\n"; out.String() != want {
+		t.Errorf("Expected an edit to be noted. Got %q.", out.String())
+	}
+
+	errs := []struct {
+		line     string
+		want_err string
+	}{
+		{"who", "Usage: who r|addr"},
+		{"who r8", "Invalid register: 'r8'"},
+		{"who rx", "Invalid register: 'rx'"},
+		{"who 1024", "Invalid address."},
+		{"who x", "Invalid number: 'x'"},
+	}
+	for i, c := range errs {
+		err := tm.command(menu, c.line)
+		if err == nil || err.Error() != c.want_err {
+			t.Errorf("%d: Expected error %q. Got %v.", i, c.want_err, err)
+		}
+	}
+}
+
+func TestWriteHistory(t *testing.T) {
+	*all_writes = true
+	defer func() { *all_writes = false }()
+
+	var tm TinyMachine
+	var out bytes.Buffer
+	if err := tm.loadProgram("test", strings.NewReader("LDC 1,4(0)\nST 1,5(0)\nLDA 1,1(1)\nST 1,5(0)\nHALT 0,0,0\n")); err != nil {
+		t.Fatalf("Unexpected error loading program.")
+	}
+	tm.stdout = &out
+	menu := tm.menu()
+	tm.command(menu, "g")
+
+	out.Reset()
+	tm.command(menu, "who 5")
+	want := "mem[5] = 5\n  4 written at step 2 by 0001: ST   1,5(0)\n  5 written at step 4 by 0003: ST   1,5(0)\n"
+	if out.String() != want {
+		t.Errorf("Expected every write to be listed. Got %q.", out.String())
+	}
+
+	tm.command(menu, "c")
+	if len(tm.writes.memhistory) != 0 || tm.writes.memory[5] != (writeRecord{}) {
+		t.Errorf("Expected writes to be forgotten on reset. Got %v.", tm.writes.memhistory)
+	}
+}
+
+func TestWhoShared(t *testing.T) {
+	// Core 1 stores its number at address 20, while core 0 halts.
+	prog := "CORE 1,0,0\nJEQ 1,1(7)\nST 1,20(0)\nHALT 0,0,0\n"
+
+	s := NewScheduler(1, 1, schedRoundRobin)
+	if err := s.LoadShared("test", strings.NewReader(prog), 2); err != nil {
+		t.Fatalf("Unexpected error loading program: %s", err)
+	}
+	var out bytes.Buffer
+	for _, p := range s.procs {
+		p.tm.stdout = &out
+	}
+	s.run()
+
+	out.Reset()
+	core0 := s.procs[0].tm
+	if err := core0.command(core0.menu(), "who 20"); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if want := "mem[20] = 1\n  1 written at step 3 by 0002: ST   1,20(0)\n"; out.String() != want {
+		t.Errorf("Expected core 0 to see core 1's write. Got %q.", out.String())
+	}
+}
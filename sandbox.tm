@@ -0,0 +1,16 @@
+* A tiny supervisor. Faults are recorded at address 100 and handled at
+* address 3, then the user program at address 8 runs in user mode.
+LDC  1,100(0)
+TVEC 1,3(0)
+USER 0,8(0)
+* The fault handler outputs the cause of the fault and the faulting PC,
+* then halts the machine.
+LD   2,101(0)
+OUT  2,0,0
+LD   2,100(0)
+OUT  2,0,0
+HALT 0,0,0
+* The user program isn't allowed to perform I/O, so its OUT traps into the
+* supervisor.
+LDC  3,5(0)
+OUT  3,0,0
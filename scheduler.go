@@ -0,0 +1,387 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"os"
+)
+
+type schedPolicy int
+
+const (
+	schedRoundRobin schedPolicy = iota // Take turns in load order
+	schedPriority                      // Highest priority first, taking turns on ties
+	schedRandom                        // Pseudo-randomly, reproducible from the seed
+)
+
+// A program loaded into one partition of a multiprogrammed machine.
+type process struct {
+	pid       int
+	name      string
+	tm        *TinyMachine
+	steps     int // Instructions executed so far
+	blockedat int // Scheduler clock when the process last blocked
+}
+
+// A Scheduler time-slices several programs on one machine. Memory is
+// divided equally between the programs, each of which also has its own
+// registers and CPU state. Alternatively, one program can be run on
+// several cores that share its memory, or each program can be given a
+// whole machine of its own.
+type Scheduler struct {
+	procs              []*process
+	current            int // Index of the running process, -1 before the first
+	inspected          int // Index of the process the REPL acts on
+	slice              int // Instructions executed in the current time slice
+	quantum            int // Instructions in a full time slice
+	policy             schedPolicy
+	unified            bool // Load programs in unified memory mode
+	partition_size     int32
+	data_memory        []int32
+	instruction_memory []TinyInstruction
+	stdin              *bufio.Reader // Shared by all processes
+	seed               int64
+	rand               *rand.Rand
+	clock              int // Instructions executed by all processes
+	progress           int // Clock when a process last didn't block
+}
+
+// Create a scheduler with memory for nprocs partitions. With no
+// partitions, only LoadMachine can be used to add programs.
+func NewScheduler(nprocs int, quantum int, policy schedPolicy) *Scheduler {
+	s := &Scheduler{
+		current: -1,
+		quantum: quantum,
+		policy:  policy,
+		stdin:   bufio.NewReader(os.Stdin),
+	}
+
+	if nprocs > 0 {
+		size := int32(*mem_size)
+		s.partition_size = size / int32(nprocs)
+		s.data_memory = make([]int32, size)
+		s.instruction_memory = make([]TinyInstruction, size)
+	}
+	s.Seed(1)
+
+	return s
+}
+
+// Set the seed for the random policy. Resetting the scheduler restarts the
+// sequence, so a run can be repeated exactly.
+func (s *Scheduler) Seed(seed int64) {
+	s.seed = seed
+	s.rand = rand.New(rand.NewSource(seed))
+}
+
+// Load a program into the next free memory partition.
+func (s *Scheduler) Load(name string, fh io.Reader) error {
+	if s.partition_size < 1 || int32(len(s.procs)+1)*s.partition_size > int32(len(s.data_memory)) {
+		return errors.New("No free memory partition for " + name)
+	}
+
+	start := int32(len(s.procs)) * s.partition_size
+	end := start + s.partition_size
+
+	tm := &TinyMachine{
+		mem_size:           s.partition_size,
+		partitioned:        true,
+		sched:              s,
+		data_memory:        s.data_memory[start:end:end],
+		instruction_memory: s.instruction_memory[start:end:end],
+		unified:            s.unified,
+		stdin:              s.stdin,
+		coreid:             int32(len(s.procs)),
+	}
+	if err := tm.loadProgram(name, fh); err != nil {
+		return err
+	}
+
+	s.procs = append(s.procs, &process{len(s.procs), name, tm, 0, 0})
+	return nil
+}
+
+// Load a program into a machine of its own, with a full sized memory.
+func (s *Scheduler) LoadMachine(name string, fh io.Reader) (*TinyMachine, error) {
+	tm := &TinyMachine{
+		sched:   s,
+		unified: s.unified,
+		stdin:   s.stdin,
+		coreid:  int32(len(s.procs)),
+	}
+	if err := tm.loadProgram(name, fh); err != nil {
+		return nil, err
+	}
+
+	s.procs = append(s.procs, &process{len(s.procs), name, tm, 0, 0})
+	return tm, nil
+}
+
+// Load a program into the first memory partition and run it on ncores
+// cores, each with its own registers, sharing the partition's memory. The
+// CORE instruction tells a core its index.
+func (s *Scheduler) LoadShared(name string, fh io.Reader, ncores int) error {
+	if len(s.procs) != 0 {
+		return errors.New("Shared memory programs must be loaded first: " + name)
+	}
+
+	if err := s.Load(name, fh); err != nil {
+		return err
+	}
+
+	first := s.procs[0].tm
+	for i := 1; i < ncores; i++ {
+		tm := &TinyMachine{
+			mem_size:           first.mem_size,
+			partitioned:        true,
+			sched:              s,
+			data_memory:        first.data_memory,
+			instruction_memory: first.instruction_memory,
+			unified:            first.unified,
+			image:              first.image,
+			initdata:           first.initdata,
+			initialized:        first.initialized,
+			taint:              taintState{memory: first.taint.memory},
+			writes:             provenance{memory: first.writes.memory, memhistory: first.writes.memhistory},
+			protected:          first.protected,
+			priority:           first.priority,
+			stdin:              s.stdin,
+			coreid:             int32(i),
+		}
+		// Memory is already initialized, and doing it again is harmless.
+		tm.initializeMachine(false)
+
+		s.procs = append(s.procs, &process{i, name, tm, 0, 0})
+	}
+
+	return nil
+}
+
+// Execute one instruction, first switching processes if the running one
+// has used up its time slice or stopped. A process that blocks gives up
+// the rest of its time slice. Returns false, without executing anything,
+// once no process is able to run.
+func (s *Scheduler) step() bool {
+	if s.deadlocked() {
+		return false
+	}
+
+	if s.current < 0 || s.slice >= s.quantum || s.procs[s.current].tm.cpustate != cpuOK {
+		if !s.schedule() {
+			return false
+		}
+	}
+
+	p := s.procs[s.current]
+	p.tm.stepProgram()
+	p.steps++
+	s.slice++
+	s.clock++
+
+	if p.tm.blocked {
+		p.blockedat = s.clock
+		s.slice = s.quantum
+	} else {
+		s.progress = s.clock
+	}
+
+	return true
+}
+
+// Report whether every process that hasn't stopped is blocked, with none
+// of them having done anything since the others blocked.
+func (s *Scheduler) deadlocked() bool {
+	waiting := false
+
+	for _, p := range s.procs {
+		if p.tm.cpustate != cpuOK {
+			continue
+		}
+		if !p.tm.blocked || p.blockedat <= s.progress {
+			return false
+		}
+		waiting = true
+	}
+
+	return waiting
+}
+
+// Choose the process for the next time slice, starting the search with
+// the one after the current process so that equals take turns. A process
+// that blocked is passed over until another has done something since, so
+// that a blocked process of high priority can't starve the one it waits
+// on.
+func (s *Scheduler) schedule() bool {
+	next, runnable := s.choose(true)
+	if next < 0 {
+		next, runnable = s.choose(false)
+	}
+
+	if next < 0 {
+		return false
+	}
+
+	if s.policy == schedRandom {
+		next = runnable[s.rand.Intn(len(runnable))]
+	}
+
+	if s.procs[next].tm.trace && next != s.current {
+		s.procs[next].tm.speak("Switching to process", next, s.procs[next].name)
+	}
+	s.current, s.slice = next, 0
+	return true
+}
+
+// Find the processes that can run, and the one the policy prefers, or -1
+// if there are none.
+func (s *Scheduler) choose(skipblocked bool) (int, []int) {
+	var runnable []int
+
+	next := -1
+	for i := 1; i <= len(s.procs); i++ {
+		j := (s.current + i) % len(s.procs)
+		p := s.procs[j]
+		if p.tm.cpustate != cpuOK || skipblocked && p.tm.blocked && p.blockedat > s.progress {
+			continue
+		}
+
+		runnable = append(runnable, j)
+		if next < 0 || (s.policy == schedPriority && p.tm.priority > s.procs[next].tm.priority) {
+			next = j
+		}
+	}
+
+	return next, runnable
+}
+
+// Run until every process has halted or faulted, or they deadlock.
+func (s *Scheduler) run() {
+	for s.step() {
+		if s.stopAtBreakpoint() {
+			return
+		}
+	}
+
+	if s.deadlocked() {
+		s.speak("Deadlock: every running process is blocked.")
+	}
+}
+
+// Check the process that just stepped for a breakpoint, inspecting it if
+// it stopped there.
+func (s *Scheduler) stopAtBreakpoint() bool {
+	p := s.procs[s.current]
+	if !p.tm.stopAtBreakpoint() {
+		return false
+	}
+
+	s.inspected = s.current
+	p.tm.speak("Stopped in process", s.current, p.name)
+	return true
+}
+
+// Restart every process from the beginning of its program.
+func (s *Scheduler) reset() {
+	for _, p := range s.procs {
+		p.tm.resetState()
+		p.steps, p.blockedat = 0, 0
+		for _, ch := range p.tm.outports {
+			ch.buf = nil
+		}
+	}
+	s.current, s.slice = -1, 0
+	s.clock, s.progress = 0, 0
+	s.Seed(s.seed)
+}
+
+// Say something through the process the REPL acts on, as the scheduler
+// has no output of its own.
+func (s *Scheduler) speak(saywhat ...interface{}) {
+	s.procs[s.inspected].tm.speak(saywhat...)
+}
+
+func (s *Scheduler) listProcesses() {
+	s.speak(fmt.Sprintf("   %3s %4s %6s %7s  %-40s %s", "PID", "PRI", "PC", "STEPS", "STATE", "NAME"))
+
+	for i, p := range s.procs {
+		mark := " "
+		if i == s.current {
+			mark = "*"
+		}
+		if i == s.inspected {
+			mark += ">"
+		} else {
+			mark += " "
+		}
+
+		state := "ready"
+		if p.tm.cpustate == cpuHALTED {
+			state = p.tm.cpustate.String()
+		} else if p.tm.cpustate != cpuOK {
+			state = fmt.Sprintf("%s at PC %d", p.tm.cpustate, p.tm.faultpc)
+		} else if p.tm.blocked {
+			state = fmt.Sprintf("blocked on %s port %d", p.tm.blockedop, p.tm.blockedport)
+		}
+
+		s.speak(fmt.Sprintf("%s %3d %4d %6d %7d  %-40s %s",
+			mark, p.pid, p.tm.priority, p.tm.registers[PC_REG], p.steps, state, p.name))
+	}
+}
+
+// Validate the time slice and scheduling policy flags.
+func schedulerFlags() (int, schedPolicy) {
+	var policy schedPolicy
+
+	switch *sched_policy {
+	case "rr":
+		policy = schedRoundRobin
+	case "priority":
+		policy = schedPriority
+	case "random":
+		policy = schedRandom
+	default:
+		log.Fatal("Unknown scheduling policy: ", *sched_policy)
+	}
+
+	if *time_slice < 1 {
+		log.Fatal("The time slice must be at least one instruction.")
+	}
+
+	return *time_slice, policy
+}
+
+// Load every named program into its own partition, or a single program
+// shared between several cores, and start the REPL.
+func runMultiprogrammed(names []string) {
+	if *cores > 1 && len(names) > 1 {
+		log.Fatal("Only a single program can be run on several cores.")
+	}
+
+	quantum, policy := schedulerFlags()
+	sched := NewScheduler(len(names), quantum, policy)
+	sched.unified = *unified
+	sched.Seed(*seed)
+
+	for _, name := range names {
+		programfile, err := os.Open(name)
+		if err != nil {
+			log.Fatalf("Error reading from %s: %s\n", name, err)
+		}
+
+		if *cores > 1 {
+			err = sched.LoadShared(name, programfile, *cores)
+		} else {
+			err = sched.Load(name, programfile)
+		}
+		programfile.Close()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	sched.procs[0].tm.Interact()
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+// Counts in register 1 forever.
+const spinProgram = "LDA 1,1(1)\nLDA 7,-2(7)\n"
+
+// Counts to 2 in register 1, then halts after 8 instructions.
+const countProgram = "LDC 2,2(0)\nLDA 1,1(1)\nSUB 3,2,1\nJGT 3,-3(7)\nHALT 0,0,0\n"
+
+func loadScheduler(t *testing.T, quantum int, policy schedPolicy, progs ...string) *Scheduler {
+	s := NewScheduler(len(progs), quantum, policy)
+	for i, prog := range progs {
+		if err := s.Load("test", bytes.NewBufferString(prog)); err != nil {
+			t.Fatalf("%d: Unexpected error loading program: %s", i, err)
+		}
+	}
+
+	return s
+}
+
+func TestSchedulerPartitions(t *testing.T) {
+	s := loadScheduler(t, 2, schedRoundRobin, spinProgram, "ST 1,1(0)\n", spinProgram)
+
+	size := int32(DEF_MEM_SIZE / 3)
+	for i, p := range s.procs {
+		if p.tm.mem_size != size {
+			t.Errorf("%d: Expected partition of %d words. Got %d.", i, size, p.tm.mem_size)
+		}
+		if s.data_memory[int32(i)*size] != size-1 {
+			t.Errorf("%d: Expected memory size %d at the start of the partition. Got %d.",
+				i, size-1, s.data_memory[int32(i)*size])
+		}
+	}
+
+	// Writes land in the process's own partition.
+	s.procs[1].tm.registers[1] = 42
+	s.procs[1].tm.stepProgram()
+	if s.data_memory[size+1] != 42 || s.data_memory[1] != 0 {
+		t.Errorf("Store didn't land in partition 1. Got %v.", []int32{s.data_memory[1], s.data_memory[size+1]})
+	}
+
+	// Addresses beyond the partition fault.
+	s.procs[1].tm.resetState()
+	s.procs[1].tm.registers[1] = 42
+	s.procs[1].tm.instruction_memory[0] = TinyInstruction{"ST", []int32{1, size, 0}, iopRM}
+	s.procs[1].tm.stepProgram()
+	if s.procs[1].tm.cpustate != cpuDMEM_ERR || s.data_memory[2*size] != size-1 {
+		t.Errorf("Expected store beyond the partition to fault. Got state %d.", s.procs[1].tm.cpustate)
+	}
+
+	if err := s.Load("extra", bytes.NewBufferString(spinProgram)); err == nil {
+		t.Errorf("Expected error loading more programs than partitions.")
+	}
+}
+
+func TestSchedulerRoundRobin(t *testing.T) {
+	s := loadScheduler(t, 2, schedRoundRobin, spinProgram, countProgram, spinProgram)
+
+	expected := []int{0, 0, 1, 1, 2, 2, 0, 0, 1, 1, 2, 2}
+	for i, pid := range expected {
+		if !s.step() {
+			t.Fatalf("%d: Expected a process to run.", i)
+		}
+		if s.current != pid {
+			t.Errorf("%d: Expected process %d to run. Got %d.", i, pid, s.current)
+		}
+	}
+
+	// Process 1 needs 4 more steps to halt, after which it is skipped.
+	expected = []int{0, 0, 1, 1, 2, 2, 0, 0, 1, 1, 2, 2, 0, 0, 2, 2}
+	for i, pid := range expected {
+		s.step()
+		if s.current != pid {
+			t.Errorf("%d: Expected process %d to run. Got %d.", i, pid, s.current)
+		}
+	}
+	if s.procs[1].tm.cpustate != cpuHALTED || s.procs[1].steps != 8 {
+		t.Errorf("Expected process 1 to halt after 8 steps. Got state %d after %d.",
+			s.procs[1].tm.cpustate, s.procs[1].steps)
+	}
+}
+
+func TestSchedulerPriority(t *testing.T) {
+	s := loadScheduler(t, 2, schedPriority,
+		".priority 1\n"+countProgram, ".priority 5\n"+countProgram, spinProgram)
+
+	// The highest priority process runs to completion first.
+	for i := 0; i < 8; i++ {
+		s.step()
+		if s.current != 1 {
+			t.Errorf("%d: Expected process 1 to run. Got %d.", i, s.current)
+		}
+	}
+	for i := 0; i < 8; i++ {
+		s.step()
+		if s.current != 0 {
+			t.Errorf("%d: Expected process 0 to run. Got %d.", i, s.current)
+		}
+	}
+	s.step()
+	if s.current != 2 {
+		t.Errorf("Expected process 2 to run. Got %d.", s.current)
+	}
+}
+
+func TestSchedulerRun(t *testing.T) {
+	s := loadScheduler(t, 3, schedRoundRobin, countProgram, "DIV 0,0,0\n", countProgram)
+
+	s.run()
+
+	expected := []TinyCPUState{cpuHALTED, cpuDIV_ZERO, cpuHALTED}
+	for i, p := range s.procs {
+		if p.tm.cpustate != expected[i] {
+			t.Errorf("%d: Expected cpu state %d. Got %d.", i, expected[i], p.tm.cpustate)
+		}
+	}
+	if s.step() {
+		t.Errorf("Expected no process to be able to run.")
+	}
+
+	s.reset()
+	for i, p := range s.procs {
+		if p.tm.cpustate != cpuOK || p.steps != 0 {
+			t.Errorf("%d: Expected process to be reset. Got state %d after %d steps.",
+				i, p.tm.cpustate, p.steps)
+		}
+	}
+}
+
+func TestMulticore(t *testing.T) {
+	// Each core adds 1 to the counter at address 1 ten times, then stores
+	// its core number at address 2 plus the number.
+	prog := "LDC 2,10(0)\nLDC 3,1(0)\nLDA 4,0(3)\nFAA 4,1(0)\nSUB 2,2,3\nJGT 2,-4(7)\n" +
+		"CORE 5,0,0\nST 5,2(5)\nHALT 0,0,0\n"
+
+	var traces [2][]int
+	for run := range traces {
+		s := NewScheduler(1, 1, schedRandom)
+		s.Seed(42)
+		if err := s.LoadShared("test", bytes.NewBufferString(prog), 4); err != nil {
+			t.Fatalf("Unexpected error loading program: %s", err)
+		}
+
+		for s.step() {
+			traces[run] = append(traces[run], s.current)
+		}
+
+		if s.data_memory[1] != 40 {
+			t.Errorf("%d: Expected shared counter to be 40. Got %d.", run, s.data_memory[1])
+		}
+		for i := int32(0); i < 4; i++ {
+			if s.data_memory[2+i] != i {
+				t.Errorf("%d: Expected core %d to store its number. Got %d.", run, i, s.data_memory[2+i])
+			}
+		}
+	}
+
+	if !reflect.DeepEqual(traces[0], traces[1]) {
+		t.Errorf("Expected the same seed to give the same interleaving.")
+	}
+
+	// The cores shouldn't simply have taken turns.
+	inorder := true
+	for i := 1; i < len(traces[0]); i++ {
+		if traces[0][i] != traces[0][i-1] && traces[0][i] != (traces[0][i-1]+1)%4 {
+			inorder = false
+		}
+	}
+	if inorder {
+		t.Errorf("Expected random interleaving. Got %v.", traces[0])
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Scripts nest through source, but not without limit.
+const MAX_SCRIPT_DEPTH = 8
+
+// A recorder saves the input to a REPL session as a script that replays
+// it. Answers to prompts and input for IN are recorded along with the
+// commands that asked for them. Commands that fail are commented out,
+// along with their answers.
+type recorder struct {
+	w     io.WriteCloser
+	lines []string // Input read for the command being run
+}
+
+func (r *recorder) add(line string) {
+	if r != nil {
+		r.lines = append(r.lines, strings.TrimSuffix(line, "\n"))
+	}
+}
+
+// Write out the input for a command once it's finished.
+func (r *recorder) finish(err error) {
+	if r == nil || len(r.lines) == 0 {
+		return
+	}
+
+	if err != nil {
+		// Comment out the answers to its prompts too, so that they
+		// aren't replayed as commands.
+		for i := range r.lines {
+			r.lines[i] = "# " + r.lines[i]
+		}
+	}
+	for _, line := range r.lines {
+		fmt.Fprintln(r.w, line)
+	}
+	r.lines = nil
+}
+
+// The machines the REPL can act on, which share its input.
+func (tm *TinyMachine) replMachines() []*TinyMachine {
+	if tm.sched == nil {
+		return []*TinyMachine{tm}
+	}
+
+	var machines []*TinyMachine
+	for _, p := range tm.sched.procs {
+		machines = append(machines, p.tm)
+	}
+	return machines
+}
+
+// Start recording input to the named file, or stop if name is empty.
+func (tm *TinyMachine) record(name string) error {
+	var r *recorder
+
+	if name != "" {
+		fh, err := os.Create(name)
+		if err != nil {
+			return err
+		}
+		r = &recorder{w: fh}
+	}
+
+	if tm.recorder != nil {
+		tm.recorder.w.Close()
+	}
+	for _, m := range tm.replMachines() {
+		m.recorder = r
+	}
+
+	return nil
+}
+
+// Run the REPL commands in the named file, echoing each one. Blank lines
+// and lines starting with # are skipped. Prompts and IN read the lines
+// that follow the command. The script stops at the first command that
+// fails.
+func (tm *TinyMachine) runScript(menu map[string]menuAction, name string) error {
+	if tm.scriptdepth >= MAX_SCRIPT_DEPTH {
+		return errors.New("Scripts are nested too deeply: " + name)
+	}
+
+	fh, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+
+	// Swap the script in for the REPL's input, and don't record it.
+	reader := bufio.NewReader(fh)
+	machines := tm.replMachines()
+	stdin, r := tm.stdin, tm.recorder
+	for _, m := range machines {
+		m.stdin, m.recorder = reader, nil
+		m.scriptdepth++
+	}
+	defer func() {
+		for _, m := range machines {
+			m.stdin, m.recorder = stdin, r
+			m.scriptdepth--
+		}
+	}()
+
+	linenum := 0
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return err
+		} else if err == io.EOF && line == "" {
+			return nil
+		}
+		linenum++
+
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		tm.speak("> " + line)
+		if err := tm.command(menu, line); err != nil {
+			return fmt.Errorf("Error in %s at line %d: %s", name, linenum, err)
+		}
+	}
+}
+
+func handleSource(tm *TinyMachine, args []string) error {
+	if len(args) != 1 {
+		return errors.New("Usage: source file")
+	}
+	return tm.runScript(tm.menu(), args[0])
+}
+
+func handleRecord(tm *TinyMachine, args []string) error {
+	// A script's input isn't recorded, and the REPL's recorder is put
+	// back when it ends.
+	if tm.scriptdepth > 0 {
+		return errors.New("Recording can't be started or stopped by a script.")
+	}
+
+	if len(args) == 0 {
+		if tm.recorder == nil {
+			return errors.New("Not recording.")
+		}
+		tm.speak("Recording stopped.")
+		return tm.record("")
+	}
+
+	if err := tm.record(args[0]); err != nil {
+		return err
+	}
+	tm.speak("Recording commands to", args[0])
+	return nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRunScript(t *testing.T) {
+	dir := t.TempDir()
+	scripts := map[string]string{
+		"main":   "# Step to the IN\ns 2\n\ng\n21\nsource " + filepath.Join(dir, "nested") + "\nd 1 1\n",
+		"nested": "r\n",
+		"bad":    "s\nx\ns\n",
+		"loop":   "source " + filepath.Join(dir, "loop") + "\n",
+		"record": "record " + filepath.Join(dir, "recording") + "\n",
+	}
+	for name, script := range scripts {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(script), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	prog := "LDA 1,1(1)\nLDA 1,1(1)\nIN 2,0,0\nADD 2,2,2\nST 2,1(0)\nHALT 0,0,0\n"
+	load := func() (*TinyMachine, *bytes.Buffer) {
+		var tm TinyMachine
+		var out bytes.Buffer
+		if err := tm.loadProgram("test", bytes.NewBufferString(prog)); err != nil {
+			t.Fatalf("Unexpected error loading program.")
+		}
+		tm.stdout = &out
+		tm.stdin = bufio.NewReader(strings.NewReader("terminal\n"))
+		return &tm, &out
+	}
+
+	tm, out := load()
+	stdin := tm.stdin
+	if err := tm.runScript(tm.menu(), filepath.Join(dir, "main")); err != nil {
+		t.Fatalf("Unexpected error running script: %s", err)
+	}
+	if tm.data_memory[1] != 42 || tm.cpustate != cpuHALTED {
+		t.Errorf("Expected the script to supply IN. Got %d in state %d.", tm.data_memory[1], tm.cpustate)
+	}
+	for _, want := range []string{"> s 2\n", "> g\n", "nested\n> r\n", "> d 1 1\n"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("Expected the script to echo %q. Got %q.", want, out.String())
+		}
+	}
+	if tm.stdin != stdin || tm.scriptdepth != 0 {
+		t.Errorf("Expected input to be restored after the script.")
+	}
+
+	tm, _ = load()
+	err := tm.runScript(tm.menu(), filepath.Join(dir, "bad"))
+	want := "Error in " + filepath.Join(dir, "bad") + " at line 2: Unknown command: 'x'. Try 'h' for help."
+	if err == nil || err.Error() != want {
+		t.Errorf("Expected error %q. Got %v.", want, err)
+	}
+	if tm.registers[PC_REG] != 1 {
+		t.Errorf("Expected the script to stop at the error. Got PC %d.", tm.registers[PC_REG])
+	}
+
+	tm, _ = load()
+	if err := tm.runScript(tm.menu(), filepath.Join(dir, "loop")); err == nil ||
+		!strings.Contains(err.Error(), "Scripts are nested too deeply") {
+		t.Errorf("Expected a script sourcing itself to fail. Got %v.", err)
+	}
+
+	tm, _ = load()
+	err = tm.runScript(tm.menu(), filepath.Join(dir, "record"))
+	want = "Error in " + filepath.Join(dir, "record") + " at line 1: Recording can't be started or stopped by a script."
+	if err == nil || err.Error() != want || tm.recorder != nil {
+		t.Errorf("Expected error %q. Got %v.", want, err)
+	}
+}
+
+func TestRecord(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "session")
+
+	var tm TinyMachine
+	var out bytes.Buffer
+	if err := tm.loadProgram("test", bytes.NewBufferString("IN 1,0,0\nST 1,1(0)\nHALT 0,0,0\n")); err != nil {
+		t.Fatalf("Unexpected error loading program.")
+	}
+	tm.stdout = &out
+	tm.stdin = bufio.NewReader(strings.NewReader("7\n5\n1\n"))
+
+	menu := tm.menu()
+	for _, input := range []string{"record " + name + "\n", "s\n", "bogus\n", "d\n", "g\n", "record\n"} {
+		tm.enter(menu, input)
+	}
+
+	recorded, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "s\n7\n# bogus\n# d\n# 5\n# 1\ng\n"
+	if string(recorded) != want {
+		t.Errorf("Expected recording %q. Got %q.", want, recorded)
+	}
+
+	// Replaying the recording repeats the session.
+	tm.resetState()
+	if err := tm.runScript(menu, name); err != nil {
+		t.Fatalf("Unexpected error replaying: %s", err)
+	}
+	if tm.data_memory[1] != 7 || tm.cpustate != cpuHALTED {
+		t.Errorf("Expected replay to store 7 and halt. Got %d in state %d.", tm.data_memory[1], tm.cpustate)
+	}
+}
@@ -0,0 +1,11 @@
+* Run with --unified. The program patches the constant loaded by the LDC
+* at address 3 before executing it, so it outputs 42 rather than 0.
+*
+* Load the encoded LDC instruction, add 42 to its constant field and
+* store it back.
+LD   1,3(0)
+LDA  1,42(1)
+ST   1,3(0)
+LDC  2,0(0)
+OUT  2,0,0
+HALT 0,0,0
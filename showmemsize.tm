@@ -1,3 +1,5 @@
+* Address 0 holds the memory size, which nothing should overwrite.
+.protect 0 0 ro
 * The first (0th) memory address is initialized with the size of the
 * data memory. Read that value into register 0.
 LD 0,0(0)
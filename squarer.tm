@@ -0,0 +1,7 @@
+* Receive numbers on port 0 and output their squares, until 0 arrives.
+RECV 1,0(0)
+JEQ  1,3(7)
+MUL  1,1,1
+OUT  1,0,0
+LDA  7,-5(7)
+HALT 0,0,0
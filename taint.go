@@ -0,0 +1,170 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Taint tracking marks values read by IN, and everything computed from
+// them, so that a program can be caught using input as a memory address
+// or jump target. Taint follows data, not control: a value chosen by a
+// jump on a tainted condition isn't tainted.
+type taintState struct {
+	mode      string // report or fault, or empty if off
+	registers [NUM_REGS]bool
+	memory    []bool // By physical address
+}
+
+// How an instruction changes taint, worked out before it executes.
+type taintEffect struct {
+	reg    int32 // Register written, or -1
+	regval bool
+	mem    int32 // Physical address written, or -1
+	memval bool
+	jump   bool // A jump taken goes to a tainted address
+}
+
+func (t *taintState) reset(mem_size int32, mode string) {
+	memory := t.memory
+	*t = taintState{mode: mode}
+	if mode == "" {
+		return
+	}
+
+	if len(memory) != int(mem_size) {
+		memory = make([]bool, mem_size)
+	} else {
+		// Cores sharing memory share this too.
+		clear(memory)
+	}
+	t.memory = memory
+}
+
+// Report whether a data address is tainted, if it's valid.
+func (tm *TinyMachine) taintedAt(addr int32) (int32, bool) {
+	pa, ok := tm.translate(addr, false)
+	if !ok || pa < 0 || pa >= tm.mem_size {
+		return -1, false
+	}
+	return pa, tm.taint.memory[pa]
+}
+
+// Check the data address an instruction will use, reporting it if it's
+// tainted. Returns the address, and whether it should fault.
+func (tm *TinyMachine) checkAddressTaint(pc int32, ti TinyInstruction) (int32, bool) {
+	if tm.taint.mode == "" {
+		return 0, false
+	}
+
+	var addr int32
+	switch ti.iop {
+	case "LD", "ST", "FAA":
+		if !tm.taint.registers[ti.iargs[2]] {
+			return 0, false
+		}
+		addr = ti.iargs[1] + tm.registers[ti.iargs[2]]
+	case "CAS":
+		if !tm.taint.registers[ti.iargs[1]] {
+			return 0, false
+		}
+		addr = tm.registers[ti.iargs[1]]
+	default:
+		return 0, false
+	}
+
+	return addr, tm.taintedUse(pc, "memory address", addr)
+}
+
+// Say that a tainted value was used, returning whether it should fault.
+func (tm *TinyMachine) taintedUse(pc int32, what string, v int32) bool {
+	if tm.taint.mode == "fault" {
+		return true
+	}
+	tm.speak(fmt.Sprintf("Tainted %s %d used at PC %d.", what, v, pc))
+	return false
+}
+
+// Work out how an instruction will change taint, given the address its
+// d(s) operand refers to.
+func (tm *TinyMachine) taintEffects(ti TinyInstruction, a int32) taintEffect {
+	fx := taintEffect{reg: -1, mem: -1}
+	regs := &tm.taint.registers
+	r, s, t := ti.iargs[0], ti.iargs[1], ti.iargs[2]
+
+	switch ti.iop {
+	case "IN":
+		fx.reg, fx.regval = r, true
+	case "ADD", "SUB", "MUL", "DIV":
+		fx.reg, fx.regval = r, regs[s] || regs[t]
+	case "LDA":
+		fx.reg, fx.regval = r, regs[t]
+	case "LD":
+		_, tainted := tm.taintedAt(a)
+		fx.reg, fx.regval = r, tainted
+	case "ST":
+		fx.mem, _ = tm.taintedAt(a)
+		fx.memval = regs[r]
+	case "CAS":
+		// Memory only changes if the swap happens.
+		fx.reg = r
+		if pa, _ := tm.taintedAt(tm.registers[s]); pa >= 0 && tm.data_memory[pa] == tm.registers[r] {
+			fx.mem, fx.memval = pa, regs[t]
+		}
+	case "FAA":
+		var tainted bool
+		fx.mem, tainted = tm.taintedAt(a)
+		fx.memval = tainted || regs[r]
+		fx.reg, fx.regval = r, tainted
+	case "JLT", "JLE", "JGE", "JGT", "JEQ", "JNE", "USER":
+		fx.jump = regs[t]
+	default:
+		if writesRegister[ti.iop] {
+			fx.reg = r
+		}
+	}
+
+	// Writing the PC is a jump.
+	if fx.reg == PC_REG {
+		fx.reg, fx.jump = -1, fx.regval
+	}
+	return fx
+}
+
+// Apply the taint changes of an instruction that completed. Returns
+// whether it jumped to a tainted address and should fault.
+func (tm *TinyMachine) applyTaint(pc int32, fx taintEffect) bool {
+	if fx.reg >= 0 {
+		tm.taint.registers[fx.reg] = fx.regval
+	}
+	if fx.mem >= 0 {
+		tm.taint.memory[fx.mem] = fx.memval
+	}
+
+	target := tm.registers[PC_REG]
+	return fx.jump && target != pc+1 && tm.taintedUse(pc, "jump target", target)
+}
+
+// List the tainted registers and memory cells.
+func handleTaint(tm *TinyMachine, args []string) error {
+	if tm.taint.mode == "" {
+		return errors.New("Taint tracking is off. Run with -taint report or -taint fault.")
+	}
+
+	var regs []string
+	for r, tainted := range tm.taint.registers {
+		if tainted {
+			regs = append(regs, fmt.Sprintf("r%d", r))
+		}
+	}
+	tm.speak("Tainted registers:", strings.Join(regs, " "))
+
+	var cells []string
+	for addr, tainted := range tm.taint.memory {
+		if tainted {
+			cells = append(cells, fmt.Sprint(addr))
+		}
+	}
+	tm.speak("Tainted memory:", strings.Join(cells, " "))
+	return nil
+}
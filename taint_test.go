@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// Reads an index, storing it and using it as an address and a jump target.
+const taintProgram = `IN 1,0,0
+LDC 2,10(0)
+ADD 3,1,2
+LDA 4,1(3)
+ST 1,0(2)
+LD 5,0(2)
+LDC 1,0(0)
+LD 6,0(3)
+LDA 7,20(5)
+`
+
+func TestTaintReport(t *testing.T) {
+	*taint_mode = "report"
+	defer func() { *taint_mode = "" }()
+
+	var tm TinyMachine
+	var out bytes.Buffer
+	if err := tm.loadProgram("test", strings.NewReader(taintProgram)); err != nil {
+		t.Fatalf("Unexpected error loading program.")
+	}
+	tm.stdin = bufio.NewReader(strings.NewReader("3\n"))
+	tm.stdout = &out
+	menu := tm.menu()
+
+	tm.command(menu, "g")
+	if tm.cpustate != cpuHALTED || tm.registers[PC_REG] != 24 {
+		t.Errorf("Expected to halt at 23. Got state %d at PC %d.", tm.cpustate, tm.registers[PC_REG])
+	}
+	for _, want := range []string{"Tainted memory address 13 used at PC 7.\n", "Tainted jump target 23 used at PC 8.\n"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("Expected %q to be reported. Got %q.", want, out.String())
+		}
+	}
+
+	out.Reset()
+	tm.command(menu, "taint")
+	if want := "Tainted registers: r3 r4 r5\nTainted memory: 10\n"; out.String() != want {
+		t.Errorf("Expected %q. Got %q.", want, out.String())
+	}
+
+	tm.command(menu, "c")
+	if tm.taint.registers[3] || tm.taint.memory[10] {
+		t.Errorf("Expected taint to be cleared on reset.")
+	}
+}
+
+func TestTaintFault(t *testing.T) {
+	*taint_mode = "fault"
+	defer func() { *taint_mode = "" }()
+
+	cases := []struct {
+		prog      string
+		faultpc   int32
+		faultaddr int32
+	}{
+		{taintProgram, 7, 13},
+		{strings.Replace(taintProgram, "LD 6,0(3)", "LD 6,0(2)", 1), 8, 23},
+		{"IN 1,0,0\nLDC 2,5(0)\nFAA 1,0(2)\nLD 3,5(0)\nCAS 4,3,0\n", 4, 3},
+		{"IN 1,0,0\nLD 7,0(1)\n", 1, 3},
+	}
+
+	for i, c := range cases {
+		var tm TinyMachine
+		if err := tm.loadProgram("test", strings.NewReader(c.prog)); err != nil {
+			t.Fatalf("%d: Unexpected error loading program.", i)
+		}
+		tm.stdin = bufio.NewReader(strings.NewReader("3\n"))
+		tm.stdout = &bytes.Buffer{}
+
+		tm.runProgram()
+		if tm.cpustate != cpuTAINT_ERR || tm.faultpc != c.faultpc || tm.faultaddr != c.faultaddr {
+			t.Errorf("%d: Expected a taint fault at PC %d on address %d. Got state %d at PC %d on address %d.",
+				i, c.faultpc, c.faultaddr, tm.cpustate, tm.faultpc, tm.faultaddr)
+		}
+	}
+}
+
+func TestTaintCAS(t *testing.T) {
+	*taint_mode = "report"
+	defer func() { *taint_mode = "" }()
+
+	// Stores the input at address 5, then tries to swap an untainted 0
+	// into it, which only happens if r4 holds the input.
+	cases := []struct {
+		r4      string
+		tainted bool
+	}{
+		{"0", true},
+		{"3", false},
+	}
+
+	for i, c := range cases {
+		prog := "IN 1,0,0\nLDC 2,5(0)\nST 1,0(2)\nLDC 4," + c.r4 + "(0)\nCAS 4,2,6\nHALT 0,0,0\n"
+
+		var tm TinyMachine
+		if err := tm.loadProgram("test", strings.NewReader(prog)); err != nil {
+			t.Fatalf("%d: Unexpected error loading program.", i)
+		}
+		tm.stdin = bufio.NewReader(strings.NewReader("3\n"))
+		tm.stdout = &bytes.Buffer{}
+
+		tm.runProgram()
+		if tm.taint.memory[5] != c.tainted {
+			t.Errorf("%d: Expected address 5 to be tainted %t. Got %t.", i, c.tainted, tm.taint.memory[5])
+		}
+	}
+}
+
+func TestTaintShared(t *testing.T) {
+	*taint_mode = "report"
+	defer func() { *taint_mode = "" }()
+
+	// Core 0 stores input at address 5, while core 1 halts.
+	prog := "CORE 1,0,0\nJNE 1,2(7)\nIN 2,0,0\nST 2,5(0)\nHALT 0,0,0\n"
+
+	s := NewScheduler(1, 1, schedRoundRobin)
+	s.stdin = bufio.NewReader(strings.NewReader("3\n"))
+	if err := s.LoadShared("test", strings.NewReader(prog), 2); err != nil {
+		t.Fatalf("Unexpected error loading program: %s", err)
+	}
+	for _, p := range s.procs {
+		p.tm.stdout = &bytes.Buffer{}
+	}
+
+	s.run()
+	for i, p := range s.procs {
+		if !p.tm.taint.memory[5] {
+			t.Errorf("%d: Expected core to see that address 5 is tainted.", i)
+		}
+	}
+}
+
+func TestTaintOff(t *testing.T) {
+	var tm TinyMachine
+	tm.stdout = &bytes.Buffer{}
+	tm.initializeMachine(true)
+
+	err := tm.command(tm.menu(), "taint")
+	if want := "Taint tracking is off. Run with -taint report or -taint fault."; err == nil || err.Error() != want {
+		t.Errorf("Expected error %q. Got %v.", want, err)
+	}
+}
@@ -0,0 +1,17 @@
+* Handle interrupts at address 7, saving the interrupted PC at address 100.
+LDC  1,100(0)
+IVEC 1,7(0)
+* Interrupt every 10 instructions.
+LDC  2,10(0)
+STIM 2,0,0
+EI   0,0,0
+* Spin forever, counting loop iterations in register 3.
+LDA  3,1(3)
+LDA  7,-2(7)
+* The interrupt handler. Output the count, then stop once it reaches 20.
+OUT  3,0,0
+LDC  4,20(0)
+SUB  4,3,4
+JGE  4,1(7)
+RTI  0,0,0
+HALT 0,0,0
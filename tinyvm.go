@@ -9,6 +9,7 @@ import (
 	"log"
 	"os"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 )
@@ -18,15 +19,50 @@ const (
 	DEF_MEM_SIZE = 1024
 	NUM_REGS     = 8 // The total number of registers available.
 	PC_REG       = 7 // The registered used as the program counter.
+
+	// When a fault is trapped, the faulting PC, the cause (the TinyCPUState
+	// value of the fault) and the faulting address are stored in
+	// consecutive words of data memory, starting at the trap frame address.
+	TRAP_FRAME_PC    = 0
+	TRAP_FRAME_CAUSE = 1
+	TRAP_FRAME_ADDR  = 2
+	TRAP_FRAME_SIZE  = 3
+
+	// With paging enabled, addresses are split into a page number and an
+	// offset within the page. Page table entries hold the physical frame
+	// number shifted left by PTE_FRAME_SHIFT, plus flag bits. An entry
+	// without PTE_VALID set maps nothing.
+	PAGE_SIZE       = 16
+	PTE_VALID       = 0x1
+	PTE_WRITE       = 0x2
+	PTE_FRAME_SHIFT = 4
 )
 
 var (
 	mem_size = flag.Uint64("mem_size", DEF_MEM_SIZE, "This size of program and data memory.")
+	unified  = flag.Bool("unified", false, "Load the program into data memory and execute it from there.")
+
+	time_slice   = flag.Int("time_slice", 10, "Instructions each program runs before being switched out, when running several.")
+	sched_policy = flag.String("sched_policy", "rr", "How to choose the next program to run: rr (round robin), priority or random.")
+	seed         = flag.Int64("seed", 1, "Seed for the random scheduling policy.")
+	cores        = flag.Int("cores", 1, "Run the program on this many cores sharing memory.")
+	topology     = flag.String("topology", "", "Run the network of machines described by this file.")
+	gdb_addr     = flag.String("gdb", "", "Wait for a GDB remote debugger to connect on this address, e.g. :1234.")
+	lsp          = flag.Bool("lsp", false, "Serve the Language Server Protocol on stdin and stdout.")
+	http_addr    = flag.String("http", "", "Serve the HTTP/JSON control API on this address, e.g. localhost:8080.")
+	dap_addr     = flag.String("dap", "", "Serve the Debug Adapter Protocol on this address, or on stdin and stdout if -.")
+	script_file  = flag.String("script", "", "Run the REPL commands in this file before reading any from the terminal.")
+	record_file  = flag.String("record", "", "Record the REPL commands entered to this file, as a script to replay.")
+	taint_mode   = flag.String("taint", "", "Track values read by IN, and report or fault when one is used as an address: report or fault.")
+	memcheck     = flag.Bool("memcheck", false, "Report reads of data memory that hasn't been written since the machine was reset.")
+	core_file    = flag.String("core", "", "Write a core file here when a program faults, for tinyvm inspect to load.")
+	all_writes   = flag.Bool("all_writes", false, "Keep every write to each register and memory cell for the who command, not just the last.")
 )
 
 type menuAction struct {
+	args   string // Arguments, with optional ones in brackets and ... for any number
 	desc   string
-	action func(tm *TinyMachine)
+	action func(tm *TinyMachine, args []string) error
 }
 
 type TinyInstructionType int
@@ -35,8 +71,64 @@ const (
 	iopRO TinyInstructionType = iota // Register-only
 	iopRM TinyInstructionType = iota // Register-memory
 	iopRA TinyInstructionType = iota // Register-address
+	iopSY TinyInstructionType = iota // System call
 )
 
+// The instruction set. The position of an opcode in this table is the
+// opcode number used when encoding instructions for unified memory, so new
+// opcodes must only ever be appended. Privileged instructions, covering
+// I/O, halting, and control of traps, interrupts and the MMU, may only be
+// executed in supervisor mode. SYS isn't privileged, so that user programs
+// can call the host.
+var opcodes = []struct {
+	name       string
+	ioptype    TinyInstructionType
+	privileged bool   // Faults in user mode
+	doc        string // What the instruction does
+}{
+	{"HALT", iopRO, true, "Stop the machine."},
+	{"IN", iopRO, true, "Read a number from input into reg[r]."},
+	{"OUT", iopRO, true, "Write reg[r] to output."},
+	{"ADD", iopRO, false, "reg[r] = reg[s] + reg[t]."},
+	{"SUB", iopRO, false, "reg[r] = reg[s] - reg[t]."},
+	{"MUL", iopRO, false, "reg[r] = reg[s] * reg[t]."},
+	{"DIV", iopRO, false, "reg[r] = reg[s] / reg[t], faulting if reg[t] is 0."},
+	{"LD", iopRM, false, "reg[r] = dMem[d + reg[s]]."},
+	{"ST", iopRM, false, "dMem[d + reg[s]] = reg[r]."},
+	{"LDA", iopRA, false, "reg[r] = d + reg[s]."},
+	{"LDC", iopRA, false, "reg[r] = d."},
+	{"JLT", iopRA, false, "Jump to d + reg[s] if reg[r] < 0."},
+	{"JLE", iopRA, false, "Jump to d + reg[s] if reg[r] <= 0."},
+	{"JGE", iopRA, false, "Jump to d + reg[s] if reg[r] >= 0."},
+	{"JGT", iopRA, false, "Jump to d + reg[s] if reg[r] > 0."},
+	{"JEQ", iopRA, false, "Jump to d + reg[s] if reg[r] == 0."},
+	{"JNE", iopRA, false, "Jump to d + reg[s] if reg[r] != 0."},
+	{"SYS", iopSY, false, "Call the host's handler for system call n."},
+	{"TVEC", iopRA, true, "Install the fault handler at d + reg[s], with its frame at dMem[reg[r]]. A negative address removes it."},
+	{"RTT", iopRO, true, "Return from the fault handler to the PC saved in its frame."},
+	{"IVEC", iopRA, true, "Install the interrupt handler at d + reg[s], saving the interrupted PC at dMem[reg[r]]."},
+	{"STIM", iopRO, true, "Interrupt every reg[r] instructions, or never if reg[r] is 0."},
+	{"EI", iopRO, true, "Enable interrupts."},
+	{"DI", iopRO, true, "Disable interrupts."},
+	{"RTI", iopRO, true, "Return from the interrupt handler and enable interrupts."},
+	{"PTB", iopRA, true, "Translate addresses through the reg[r] entry page table at d + reg[s], or stop if reg[r] <= 0."},
+	{"USER", iopRA, true, "Jump to d + reg[s] in user mode."},
+	{"CAS", iopRO, false, "If dMem[reg[s]] == reg[r], atomically set it to reg[t] and reg[r] to 1. Otherwise reg[r] = 0."},
+	{"FAA", iopRM, false, "Atomically add reg[r] to dMem[d + reg[s]], leaving the old value in reg[r]."},
+	{"CORE", iopRO, false, "reg[r] = the number of this core."},
+	{"SEND", iopRA, true, "Send reg[r] on port d + reg[s], waiting while the channel is full."},
+	{"RECV", iopRA, true, "reg[r] = the next word from port d + reg[s], waiting while the channel is empty."},
+}
+
+// Map opcode names to their position in the opcodes table.
+var opcodeNumbers = func() map[string]int32 {
+	numbers := make(map[string]int32)
+	for i, op := range opcodes {
+		numbers[op.name] = int32(i)
+	}
+	return numbers
+}()
+
 // Instructions are composed of one operation and up to three
 // arguments.
 type TinyInstruction struct {
@@ -53,17 +145,125 @@ const (
 	cpuDIV_ZERO
 	cpuIMEM_ERR
 	cpuDMEM_ERR
+	cpuSYS_ERR
+	cpuDECODE_ERR
+	cpuPROT_ERR
+	cpuPAGE_FAULT
+	cpuPRIV_ERR
+	cpuPORT_ERR
+	cpuTAINT_ERR
 )
 
+func (s TinyCPUState) String() string {
+	switch s {
+	case cpuOK:
+		return "ok"
+	case cpuHALTED:
+		return "halted"
+	case cpuDIV_ZERO:
+		return "divide by zero"
+	case cpuIMEM_ERR:
+		return "instruction memory access violation"
+	case cpuDMEM_ERR:
+		return "data memory access violation"
+	case cpuSYS_ERR:
+		return "system call error"
+	case cpuDECODE_ERR:
+		return "illegal instruction"
+	case cpuPROT_ERR:
+		return "memory protection violation"
+	case cpuPAGE_FAULT:
+		return "page fault"
+	case cpuPRIV_ERR:
+		return "privileged instruction in user mode"
+	case cpuPORT_ERR:
+		return "unconnected port"
+	case cpuTAINT_ERR:
+		return "tainted address"
+	}
+
+	return fmt.Sprintf("unknown state %d", int(s))
+}
+
+type MemProtection int
+
+const (
+	protReadOnly MemProtection = iota
+	protWriteOnly
+	protNoAccess
+)
+
+// A range of data memory, inclusive of both ends, with restricted access.
+type protRegion struct {
+	start, end int32
+	prot       MemProtection
+}
+
+// A SyscallHandler implements the host side of a SYS instruction. It is
+// given the machine so that it can inspect and modify registers and data
+// memory, which it should write with WriteMemory so that the write is
+// recorded like a store. Returning an error puts the machine in the
+// cpuSYS_ERR state.
+type SyscallHandler func(tm *TinyMachine) error
+
 /* A structure representing a tiny machine */
 type TinyMachine struct {
-	stdin              *bufio.Reader     // To handle data input
-	registers          [NUM_REGS]int32   // 8 registers
-	mem_size           int32             // How many memory slots
-	data_memory        []int32           // Data memory
-	instruction_memory []TinyInstruction // Instruction memory
-	trace              bool              // Output instructions as they're executed
-	cpustate           TinyCPUState      // See cpu* constants above
+	stdin              *bufio.Reader            // To handle data input
+	stdout             io.Writer                // Where output and prompts go
+	outhook            func(v int32)            // Receives OUT values instead of stdout, if set
+	registers          [NUM_REGS]int32          // 8 registers
+	mem_size           int32                    // How many memory slots
+	partitioned        bool                     // Memory is a partition provided by a Scheduler
+	coresize           int32                    // Memory size from a core file, instead of -mem_size
+	sched              *Scheduler               // Scheduler running this machine, if any
+	priority           int32                    // Scheduling priority, higher runs first
+	coreid             int32                    // Index of this core or process in its Scheduler
+	session            string                   // HTTP API session running this machine, if any
+	outports           map[int32]*channel       // Channels written by SEND, by port
+	inports            map[int32]*channel       // Channels read by RECV, by port
+	blocked            bool                     // The last instruction must wait and be retried
+	blockedop          string                   // The instruction that blocked
+	blockedport        int32                    // The port it blocked on
+	data_memory        []int32                  // Data memory
+	instruction_memory []TinyInstruction        // Instruction memory
+	unified            bool                     // Instructions are encoded in data memory
+	image              []int32                  // Encoded program, in unified mode
+	initdata           map[int32]int32          // Data memory set by .data directives, by address
+	initialized        []bool                   // Data memory cells written, with -memcheck
+	progname           string                   // Name of the program loaded
+	srclines           []int                    // Source line of each instruction, by address
+	recent             []executed               // The last instructions executed, for crash reports
+	recentnext         int                      // Where the next one goes once recent is full
+	protected          []protRegion             // Data memory access restrictions
+	paging             bool                     // Addresses are translated through the page table
+	ptbase             int32                    // Physical address of the page table
+	ptlen              int32                    // Number of entries in the page table
+	trace              bool                     // Output instructions as they're executed
+	breakpoints        map[int32]*breakpoint    // PCs where a debugger stops the program
+	recorder           *recorder                // Records REPL input, if recording
+	scriptdepth        int                      // Number of REPL scripts being run
+	cpustate           TinyCPUState             // See cpu* constants above
+	usermode           bool                     // Privileged instructions fault
+	syscalls           map[int32]SyscallHandler // Host handlers for SYS, by number
+	syserr             error                    // Error from the last failed SYS
+	faultpc            int32                    // PC of the last faulting instruction
+	faultaddr          int32                    // Address involved in the last fault
+	trapset            bool                     // A fault handler has been installed
+	trapvec            int32                    // Address of the fault handler
+	trapframe          int32                    // Data address where faults are recorded
+	intrap             bool                     // Executing the fault handler
+	trapusermode       bool                     // Mode to restore on RTT
+	ivecset            bool                     // An interrupt handler has been installed
+	ivec               int32                    // Address of the interrupt handler
+	iframe             int32                    // Data address where the interrupted PC is saved
+	intenabled         bool                     // Interrupts will be delivered
+	intpending         bool                     // An interrupt is waiting for delivery
+	timerperiod        int32                    // Instructions between timer interrupts, 0 if off
+	timercount         int32                    // Instructions since the last timer interrupt
+	steps              int                      // Instructions executed since the last reset
+	writes             provenance               // What wrote each register and memory cell
+	taint              taintState               // Which values are derived from input
+	intusermode        bool                     // Mode to restore on RTI
 }
 
 func (ti TinyInstruction) String() string {
@@ -72,6 +272,8 @@ func (ti TinyInstruction) String() string {
 	switch ti.ioptype {
 	case iopRO:
 		s = fmt.Sprintf("%-4s %d,%d,%d", ti.iop, ti.iargs[0], ti.iargs[1], ti.iargs[2])
+	case iopSY:
+		s = fmt.Sprintf("%-4s %d", ti.iop, ti.iargs[0])
 	default:
 		s = fmt.Sprintf("%-4s %d,%d(%d)", ti.iop, ti.iargs[0], ti.iargs[1], ti.iargs[2])
 	}
@@ -79,113 +281,101 @@ func (ti TinyInstruction) String() string {
 	return s
 }
 
-// Operands are of the form r,s,t where r, s and t are all integers
+// Operands are of the form r,s,t where r, s and t are all registers.
+// Errors are *ParseErrors, with columns counted from the start of args.
 func parseROop(args string) ([]int32, error) {
-	string_args := strings.Split(args, ",")
-	converted_args := make([]int32, 3)
-
-	if len(string_args) != 3 {
-		return nil, errors.New("Invalid arguments: " + args)
-	} else {
-		for i := 0; i < 3; i++ {
-			num, err := strconv.ParseInt(string_args[i], 10, 32)
-			if err != nil {
-				return nil, errors.New("Invalid arguments: " + args)
-			} else {
-				// Ensure that all operands are valid registers
-				if num < 0 || num >= NUM_REGS {
-					return nil, errors.New("Invalid arguments. Bad register: " + string_args[i])
-				} else {
-					converted_args[i] = int32(num)
-				}
-			}
-		}
-	}
-
-	return converted_args, nil
+	return parseFormat("r,s,t", args)
 }
 
-// Operands are of the form r,s(t) where r, s and t are all integers
+// Operands are of the form r,d(s) where r and s are registers and d is an
+// integer. Errors are *ParseErrors, with columns counted from the start
+// of args.
 func parseRMop(args string) ([]int32, error) {
-	converted_args := make([]int32, 3)
+	return parseFormat("r,d(s)", args)
+}
 
-	x := strings.Index(args, ",")
-	y := strings.Index(args, "(")
-	z := strings.Index(args, ")")
+// Operand is of the form n where n is a non-negative integer
+func parseSYop(args string) ([]int32, error) {
+	return parseFormat("n", args)
+}
 
-	if x < 1 || y < x || z < y {
-		return nil, errors.New("Invalid arguments: " + args)
-	} else {
-		indexes := [][]int{[]int{0, x}, []int{x + 1, y}, []int{y + 1, z}}
+// Parse the operands of an instruction of the given type.
+func parseOperands(ioptype TinyInstructionType, args string) ([]int32, error) {
+	switch ioptype {
+	case iopRM, iopRA:
+		return parseRMop(args)
+	case iopSY:
+		return parseSYop(args)
+	}
 
-		for i, bounds := range indexes {
-			str_num := args[bounds[0]:bounds[1]]
-			num, err := strconv.ParseInt(str_num, 10, 32)
+	return parseROop(args)
+}
 
-			if err != nil {
-				return nil, errors.New("Invalid arguments: " + args)
-			} else {
-				// Ensure that the 1st and 3rd operands are valid registers
-				if (i == 0 || i == 2) && (num < 0 || num >= NUM_REGS) {
-					return nil, errors.New("Invalid arguments. Bad register: " + str_num)
-				} else {
-					converted_args[i] = int32(num)
-				}
-			}
-		}
+// The form of the operands taken by each type of instruction.
+func operandFormat(ioptype TinyInstructionType) string {
+	switch ioptype {
+	case iopRM, iopRA:
+		return "r,d(s)"
+	case iopSY:
+		return "n"
 	}
 
-	return converted_args, nil
+	return "r,s,t"
 }
 
+// Parse a line holding an instruction. Mnemonics may be in any case, and
+// whitespace may separate operands. Errors are *ParseErrors, with columns
+// counted from the start of the line.
 func parseInstruction(line string) (TinyInstruction, error) {
-	var args []int32
-	var err error
 	var ti TinyInstruction
-	var ioptype TinyInstructionType
 
-	// Chop the newline off and then split on spaces
-	r := regexp.MustCompile(" +")
-	stripped_line := strings.TrimSpace(r.ReplaceAllString(line, " "))
-	line_parts := strings.Split(stripped_line, " ")
+	op, operands, err := splitInstruction(line)
+	if err != nil {
+		return ti, err
+	}
 
-	if len(line_parts) != 2 {
-		return ti, errors.New("Invalid instruction: '" + stripped_line + "'")
-	} else {
-		switch line_parts[0] {
-		case "HALT", "IN", "OUT", "ADD", "SUB", "MUL", "DIV":
-			args, err = parseROop(line_parts[1])
-			ioptype = iopRO
-		case "LD", "ST":
-			ioptype = iopRM
-			args, err = parseRMop(line_parts[1])
-		case "LDA", "LDC", "JLT", "JLE", "JGT", "JGE", "JEQ", "JNE":
-			args, err = parseRMop(line_parts[1])
-			ioptype = iopRA
-		default:
-			return ti, errors.New("Invalid opcode: '" + line_parts[0] + "'")
-		}
+	opnum, ok := opcodeNumbers[op.text]
+	if !ok {
+		return ti, parseError(op.column, op.text, "Invalid opcode: '"+op.text+"'")
+	}
 
-		if err != nil {
-			m := "Invalid arguments for opcode " + line_parts[0] + ": '" + line_parts[1] + "'"
-			return ti, errors.New(m)
-		} else {
-			ti.iop = line_parts[0]
-			ti.iargs = args
-			ti.ioptype = ioptype
-		}
+	ioptype := opcodes[opnum].ioptype
+	args, err := parseOperands(ioptype, operands.text)
+	if err != nil {
+		// Point at the operand to blame.
+		perr := err.(*ParseError)
+		perr.Column += operands.column - 1
+		perr.Msg = "Invalid arguments for opcode " + op.text + ": '" + operands.text + "'"
+		return ti, perr
 	}
 
+	ti.iop = op.text
+	ti.iargs = args
+	ti.ioptype = ioptype
 	return ti, nil
 }
 
 func (tm *TinyMachine) speak(saywhat ...interface{}) {
-	fmt.Println(saywhat...)
+	fmt.Fprintln(tm.stdout, saywhat...)
+}
+
+// Register a host handler for SYS n. Registering a handler for a number
+// that already has one replaces it. Handlers survive machine resets.
+func (tm *TinyMachine) RegisterSyscall(n int32, handler SyscallHandler) {
+	if tm.syscalls == nil {
+		tm.syscalls = make(map[int32]SyscallHandler)
+	}
+	tm.syscalls[n] = handler
 }
 
 func (tm *TinyMachine) initializeMachine(clearprogram bool) {
-	tm.mem_size = int32(*mem_size)
-	tm.data_memory = make([]int32, tm.mem_size)
+	if !tm.partitioned {
+		tm.mem_size = int32(*mem_size)
+		if tm.coresize > 0 {
+			tm.mem_size = tm.coresize
+		}
+		tm.data_memory = make([]int32, tm.mem_size)
+	}
 
 	for i := 0; i < NUM_REGS; i++ {
 		tm.registers[i] = 0
@@ -196,17 +386,60 @@ func (tm *TinyMachine) initializeMachine(clearprogram bool) {
 	}
 
 	if clearprogram {
-		tm.instruction_memory = make([]TinyInstruction, tm.mem_size)
+		if !tm.partitioned {
+			tm.instruction_memory = make([]TinyInstruction, tm.mem_size)
+		}
 		for i := 0; i < int(tm.mem_size); i++ {
 			tm.instruction_memory[i] = TinyInstruction{"HALT", []int32{0, 0, 0}, iopRO}
 		}
 	}
 
-	// Store the size of the memory in the first memory element.
-	tm.data_memory[0] = tm.mem_size - 1
+	if clearprogram {
+		tm.image = nil
+		tm.initdata = nil
+		tm.progname = ""
+		tm.srclines = nil
+		tm.protected = nil
+		tm.priority = 0
+	}
+
+	if tm.unified {
+		// The program occupies the start of memory, so there is no room
+		// for the memory size.
+		copy(tm.data_memory, tm.image)
+	} else {
+		// Store the size of the memory in the first memory element.
+		tm.data_memory[0] = tm.mem_size - 1
+	}
+	for addr, v := range tm.initdata {
+		tm.data_memory[addr] = v
+	}
+	tm.resetMemcheck()
 	tm.cpustate = cpuOK
+	tm.usermode = false
+	tm.syserr = nil
+	tm.trapset = false
+	tm.intrap = false
+	tm.ivecset = false
+	tm.intenabled = false
+	tm.intpending = false
+	tm.timerperiod = 0
+	tm.timercount = 0
+	tm.paging = false
+	tm.steps = 0
+	tm.recent, tm.recentnext = nil, 0
+	tm.writes.reset(tm.mem_size, *all_writes)
+	tm.taint.reset(tm.mem_size, *taint_mode)
+	for _, bp := range tm.breakpoints {
+		bp.hits = 0
+	}
 	tm.registers[PC_REG] = 0
-	tm.stdin = bufio.NewReader(os.Stdin) // An io helper.
+	if tm.stdin == nil {
+		tm.stdin = bufio.NewReader(os.Stdin) // An io helper.
+	}
+	if tm.stdout == nil {
+		tm.stdout = os.Stdout
+	}
 }
 
 // Leave the loaded program intact, but re-initialize the machine to a
@@ -222,22 +455,40 @@ func (tm *TinyMachine) stepProgram() {
 		return
 	}
 
+	tm.blocked = false
 	pc := tm.registers[PC_REG]
-	if pc < 0 || pc > tm.mem_size-1 {
+	faultaddr := pc
+	if ppc, ok := tm.translate(pc, false); !ok {
+		tm.cpustate = cpuPAGE_FAULT
+	} else if ppc < 0 || ppc > tm.mem_size-1 {
 		tm.cpustate = cpuIMEM_ERR
+	} else if instruction, ok := tm.fetch(ppc); !ok {
+		tm.cpustate = cpuDECODE_ERR
+	} else if tm.usermode && opcodes[opcodeNumbers[instruction.iop]].privileged {
+		tm.cpustate = cpuPRIV_ERR
+	} else if addr, fault := tm.checkAddressTaint(pc, instruction); fault {
+		tm.cpustate, faultaddr = cpuTAINT_ERR, addr
 	} else {
 		// Step the program counter
 		tm.registers[PC_REG] = pc + 1
+		tm.noteExecuted(pc, instruction)
 
-		instruction := tm.instruction_memory[pc]
 		if tm.trace {
 			tm.speak("Executing:", instruction)
 		}
+		tm.tickTimer()
+		tm.steps++
 
 		r := instruction.iargs[0]
 		s := instruction.iargs[1]
 		t := instruction.iargs[2]
 		a := s + tm.registers[t]
+		written := int32(-1) // Memory address written, if any
+
+		var taintfx taintEffect
+		if tm.taint.mode != "" {
+			taintfx = tm.taintEffects(instruction, a)
+		}
 
 		switch instruction.iop {
 		case "HALT":
@@ -247,7 +498,11 @@ func (tm *TinyMachine) stepProgram() {
 			n := tm.readNumber(m, 0)
 			tm.registers[r] = n
 		case "OUT":
-			tm.speak(tm.registers[r])
+			if tm.outhook != nil {
+				tm.outhook(tm.registers[r])
+			} else {
+				tm.speak(tm.registers[r])
+			}
 		case "ADD":
 			tm.registers[r] = tm.registers[s] + tm.registers[t]
 		case "SUB":
@@ -265,16 +520,61 @@ func (tm *TinyMachine) stepProgram() {
 		case "LDC":
 			tm.registers[r] = s
 		case "LD":
-			if a < 0 || a >= tm.mem_size {
-				tm.cpustate = cpuDMEM_ERR
+			if pa, fault := tm.dataAddress(a, false); fault != cpuOK {
+				tm.cpustate, faultaddr = fault, a
 			} else {
-				tm.registers[r] = tm.data_memory[a]
+				tm.checkRead(pc, a, pa)
+				tm.registers[r] = tm.data_memory[pa]
 			}
 		case "ST":
-			if a < 0 || a >= tm.mem_size {
-				tm.cpustate = cpuDMEM_ERR
+			if pa, fault := tm.dataAddress(a, true); fault != cpuOK {
+				tm.cpustate, faultaddr = fault, a
+			} else {
+				tm.data_memory[pa] = tm.registers[r]
+				written = pa
+			}
+		case "CAS":
+			// Atomically replace the word at the address in s with the
+			// value in t if it holds the value in r. Sets r to 1 if the
+			// swap happened, otherwise to 0.
+			if pa, fault := tm.rmwAddress(tm.registers[s]); fault != cpuOK {
+				tm.cpustate, faultaddr = fault, tm.registers[s]
 			} else {
-				tm.data_memory[a] = tm.registers[r]
+				tm.checkRead(pc, tm.registers[s], pa)
+				if tm.data_memory[pa] == tm.registers[r] {
+					tm.data_memory[pa] = tm.registers[t]
+					tm.registers[r] = 1
+					written = pa
+				} else {
+					tm.registers[r] = 0
+				}
+			}
+		case "FAA":
+			// Atomically add r to the word at a, leaving its old value in r.
+			if pa, fault := tm.rmwAddress(a); fault != cpuOK {
+				tm.cpustate, faultaddr = fault, a
+			} else {
+				tm.checkRead(pc, a, pa)
+				tm.data_memory[pa], tm.registers[r] = tm.data_memory[pa]+tm.registers[r], tm.data_memory[pa]
+				written = pa
+			}
+		case "CORE":
+			tm.registers[r] = tm.coreid
+		case "SEND":
+			if ch, ok := tm.outports[a]; !ok {
+				tm.cpustate, faultaddr = cpuPORT_ERR, a
+			} else if len(ch.buf) >= ch.capacity {
+				tm.block(pc, "SEND", a)
+			} else {
+				ch.buf = append(ch.buf, tm.registers[r])
+			}
+		case "RECV":
+			if ch, ok := tm.inports[a]; !ok {
+				tm.cpustate, faultaddr = cpuPORT_ERR, a
+			} else if len(ch.buf) == 0 {
+				tm.block(pc, "RECV", a)
+			} else {
+				tm.registers[r], ch.buf = ch.buf[0], ch.buf[1:]
 			}
 		case "JLT":
 			if tm.registers[r] < 0 {
@@ -300,10 +600,340 @@ func (tm *TinyMachine) stepProgram() {
 			if tm.registers[r] != 0 {
 				tm.registers[PC_REG] = a
 			}
+		case "SYS":
+			tm.syscall(r)
+		case "TVEC":
+			// A negative handler address uninstalls the handler.
+			tm.trapset = a >= 0
+			tm.trapvec = a
+			tm.trapframe = tm.registers[r]
+		case "RTT":
+			tm.returnFromTrap()
+		case "IVEC":
+			// A negative handler address uninstalls the handler.
+			tm.ivecset = a >= 0
+			tm.ivec = a
+			tm.iframe = tm.registers[r]
+		case "STIM":
+			// A period of zero or less turns the timer off. The count
+			// starts with the instruction following STIM.
+			tm.timerperiod = tm.registers[r]
+			tm.timercount = 0
+		case "EI":
+			tm.intenabled = true
+		case "DI":
+			tm.intenabled = false
+		case "USER":
+			tm.registers[PC_REG] = a
+			tm.usermode = true
+		case "PTB":
+			// A table length of zero or less turns paging off.
+			tm.ptbase = a
+			tm.ptlen = tm.registers[r]
+			tm.paging = tm.ptlen > 0
+		case "RTI":
+			if tm.iframe < 0 || tm.iframe >= tm.mem_size {
+				tm.cpustate, faultaddr = cpuDMEM_ERR, tm.iframe
+			} else {
+				tm.registers[PC_REG] = tm.data_memory[tm.iframe]
+				tm.intenabled = true
+				tm.usermode = tm.intusermode
+			}
+		}
+
+		if tm.cpustate == cpuOK && !tm.blocked {
+			tm.noteInstructionWrites(pc, instruction, written)
+			if tm.taint.mode != "" && tm.applyTaint(pc, taintfx) {
+				tm.cpustate, faultaddr = cpuTAINT_ERR, tm.registers[PC_REG]
+			}
 		}
 	}
 
+	if tm.cpustate == cpuOK {
+		faultaddr = tm.interrupt(pc)
+	}
+
+	if tm.cpustate != cpuOK && tm.cpustate != cpuHALTED {
+		tm.faultpc = pc
+		tm.faultaddr = faultaddr
+		tm.trap(pc, faultaddr)
+	}
+
+	if !tm.blocked && tm.registers[PC_REG] != pc+1 {
+		tm.noteRegisterWrite(PC_REG, pc, "")
+	}
+
 	tm.handleCpuState()
+	if tm.cpustate != cpuOK && tm.cpustate != cpuHALTED {
+		tm.crash()
+	}
+}
+
+// Translate a virtual address to a physical one through the page table.
+// Returns false if the address isn't mapped, or if it's a write to a page
+// that isn't writable. Without paging, addresses are already physical.
+func (tm *TinyMachine) translate(addr int32, write bool) (int32, bool) {
+	if !tm.paging {
+		return addr, true
+	}
+
+	if addr < 0 {
+		return 0, false
+	}
+
+	page, offset := addr/PAGE_SIZE, addr%PAGE_SIZE
+	pte_addr := tm.ptbase + page
+	if page >= tm.ptlen || pte_addr < 0 || pte_addr >= tm.mem_size {
+		return 0, false
+	}
+
+	pte := tm.data_memory[pte_addr]
+	if pte&PTE_VALID == 0 || (write && pte&PTE_WRITE == 0) {
+		return 0, false
+	}
+
+	return (pte>>PTE_FRAME_SHIFT)*PAGE_SIZE + offset, true
+}
+
+// Resolve the address of a data memory access, returning the physical
+// address or the fault the access raises.
+func (tm *TinyMachine) dataAddress(addr int32, write bool) (int32, TinyCPUState) {
+	pa, ok := tm.translate(addr, write)
+	if !ok {
+		return 0, cpuPAGE_FAULT
+	} else if pa < 0 || pa >= tm.mem_size {
+		return 0, cpuDMEM_ERR
+	} else if !tm.accessible(pa, write) {
+		return 0, cpuPROT_ERR
+	}
+
+	return pa, cpuOK
+}
+
+// Resolve the address of an atomic read-modify-write, which must be both
+// readable and writable.
+func (tm *TinyMachine) rmwAddress(addr int32) (int32, TinyCPUState) {
+	pa, fault := tm.dataAddress(addr, true)
+	if fault == cpuOK && !tm.accessible(pa, false) {
+		fault = cpuPROT_ERR
+	}
+
+	return pa, fault
+}
+
+// Restrict access to data memory from start to end inclusive. Where
+// regions overlap, the most recently added one applies.
+func (tm *TinyMachine) Protect(start, end int32, prot MemProtection) error {
+	if start < 0 || end >= tm.mem_size || start > end {
+		return fmt.Errorf("Invalid memory region: %d to %d", start, end)
+	}
+
+	tm.protected = append(tm.protected, protRegion{start, end, prot})
+	return nil
+}
+
+// Report whether the program may read, or write, data memory at addr.
+func (tm *TinyMachine) accessible(addr int32, write bool) bool {
+	for i := len(tm.protected) - 1; i >= 0; i-- {
+		region := tm.protected[i]
+		if addr < region.start || addr > region.end {
+			continue
+		}
+
+		switch region.prot {
+		case protReadOnly:
+			return !write
+		case protWriteOnly:
+			return write
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+// Retrieve the instruction at address pc, decoding it from data memory in
+// unified mode. Returns false if the word there isn't a valid instruction.
+func (tm *TinyMachine) fetch(pc int32) (TinyInstruction, bool) {
+	if !tm.unified {
+		return tm.instruction_memory[pc], true
+	}
+
+	instruction, err := decodeInstruction(tm.data_memory[pc])
+	return instruction, err == nil
+}
+
+// Wind the PC back so the instruction at pc is retried on the next step,
+// once whatever it's waiting for may have happened.
+func (tm *TinyMachine) block(pc int32, op string, port int32) {
+	tm.registers[PC_REG] = pc
+	tm.blocked = true
+	tm.blockedop = op
+	tm.blockedport = port
+}
+
+// A breakpoint stops the program before it executes the instruction at
+// an address, if its condition holds.
+type breakpoint struct {
+	cond    *expr  // Stop only when this is non-zero, if set
+	condsrc string // The condition as it was entered
+	hits    int    // Times the address was reached since the last reset
+}
+
+func (tm *TinyMachine) setBreakpoint(pc int32) *breakpoint {
+	if tm.breakpoints == nil {
+		tm.breakpoints = make(map[int32]*breakpoint)
+	}
+	bp := &breakpoint{}
+	tm.breakpoints[pc] = bp
+	return bp
+}
+
+// Report whether the program has reached a breakpoint whose condition
+// holds, counting the hit. A condition that can't be evaluated stops the
+// program so that it can be fixed.
+func (tm *TinyMachine) atBreakpoint() bool {
+	stop, err := tm.checkBreakpoint()
+	if err != nil {
+		tm.speak("Error in breakpoint condition:", err)
+	}
+	return stop
+}
+
+// Like atBreakpoint, but returns the error evaluating the condition rather
+// than saying it, for callers that can't speak yet.
+func (tm *TinyMachine) checkBreakpoint() (bool, error) {
+	bp, ok := tm.breakpoints[tm.registers[PC_REG]]
+	if !ok {
+		return false, nil
+	}
+
+	bp.hits++
+	if bp.cond == nil {
+		return true, nil
+	}
+
+	v, err := bp.cond.eval(exprEnv{tm, bp.hits})
+	if err != nil {
+		return true, err
+	}
+	return v != 0, nil
+}
+
+// Check for a breakpoint after stepping, saying so if one stops the program.
+func (tm *TinyMachine) stopAtBreakpoint() bool {
+	if !tm.atBreakpoint() {
+		return false
+	}
+
+	pc := tm.registers[PC_REG]
+	tm.speak(fmt.Sprintf("Breakpoint at PC %d, hit %d times.", pc, tm.breakpoints[pc].hits))
+	return true
+}
+
+// Count an executed instruction against the timer, raising an interrupt
+// when the period expires. The interrupt stays pending until delivered.
+func (tm *TinyMachine) tickTimer() {
+	if tm.timerperiod <= 0 {
+		return
+	}
+
+	tm.timercount++
+	if tm.timercount >= tm.timerperiod {
+		tm.timercount = 0
+		tm.intpending = true
+	}
+}
+
+// Deliver a pending interrupt between instructions by saving the PC of the
+// next instruction in the interrupt frame and jumping to the handler in
+// supervisor mode. Interrupts are disabled on entry and re-enabled by RTI,
+// which also restores the interrupted mode. If the frame can't be written,
+// returns its address after raising a memory fault.
+func (tm *TinyMachine) interrupt(pc int32) int32 {
+	if !tm.intpending || !tm.intenabled || !tm.ivecset {
+		return 0
+	}
+
+	if tm.iframe < 0 || tm.iframe >= tm.mem_size {
+		tm.cpustate = cpuDMEM_ERR
+		return tm.iframe
+	}
+
+	tm.data_memory[tm.iframe] = tm.registers[PC_REG]
+	tm.noteMemoryWrite(tm.iframe, pc, "interrupt")
+	tm.registers[PC_REG] = tm.ivec
+	tm.intusermode = tm.usermode
+	tm.usermode = false
+	tm.intenabled = false
+	tm.intpending = false
+	return 0
+}
+
+// Transfer control to the installed fault handler, if any, recording the
+// fault in the trap frame. The handler runs in supervisor mode. A fault
+// raised while the handler is running, or one that can't be recorded, halts
+// the machine as it would without a handler.
+func (tm *TinyMachine) trap(pc, addr int32) {
+	frame := tm.trapframe
+	if !tm.trapset || tm.intrap || frame < 0 || frame+TRAP_FRAME_SIZE > tm.mem_size {
+		return
+	}
+
+	tm.data_memory[frame+TRAP_FRAME_PC] = pc
+	tm.data_memory[frame+TRAP_FRAME_CAUSE] = int32(tm.cpustate)
+	tm.data_memory[frame+TRAP_FRAME_ADDR] = addr
+	for i := int32(0); i < TRAP_FRAME_SIZE; i++ {
+		tm.noteMemoryWrite(frame+i, pc, "trap")
+	}
+	tm.registers[PC_REG] = tm.trapvec
+	tm.cpustate = cpuOK
+	tm.intrap = true
+	tm.trapusermode = tm.usermode
+	tm.usermode = false
+}
+
+// Resume execution at the PC stored in the trap frame, in the mode that
+// was interrupted by the fault. The handler may change the stored PC to
+// skip the faulting instruction.
+func (tm *TinyMachine) returnFromTrap() {
+	frame := tm.trapframe
+	if frame < 0 || frame+TRAP_FRAME_SIZE > tm.mem_size {
+		tm.cpustate = cpuDMEM_ERR
+	} else {
+		tm.registers[PC_REG] = tm.data_memory[frame+TRAP_FRAME_PC]
+		tm.intrap = false
+		tm.usermode = tm.trapusermode
+	}
+}
+
+// Dispatch a SYS instruction to its registered host handler.
+func (tm *TinyMachine) syscall(n int32) {
+	handler, ok := tm.syscalls[n]
+	if !ok {
+		tm.syserr = fmt.Errorf("no handler registered for system call %d", n)
+	} else {
+		tm.syserr = handler(tm)
+	}
+
+	if tm.syserr != nil {
+		tm.cpustate = cpuSYS_ERR
+	}
+}
+
+// Write a word of data memory, at a physical address, from a SYS handler.
+// The write is recorded as made by the SYS instruction, and counts as
+// initializing the cell for -memcheck.
+func (tm *TinyMachine) WriteMemory(addr, v int32) error {
+	if addr < 0 || addr >= tm.mem_size {
+		return fmt.Errorf("invalid memory address %d", addr)
+	}
+
+	tm.data_memory[addr] = v
+	// The PC has already moved past the SYS.
+	tm.noteMemoryWrite(addr, tm.registers[PC_REG]-1, "system call")
+	return nil
 }
 
 func (tm *TinyMachine) handleCpuState() {
@@ -316,6 +946,25 @@ func (tm *TinyMachine) handleCpuState() {
 		tm.speak("Instruction memory access violation. Program halted.")
 	case cpuDMEM_ERR:
 		tm.speak("Data memory access violation. Program halted.")
+	case cpuSYS_ERR:
+		tm.speak("System call error:", tm.syserr, "Program halted.")
+	case cpuDECODE_ERR:
+		tm.speak("Illegal instruction. Program halted.")
+	case cpuPROT_ERR:
+		tm.speak(fmt.Sprintf("Memory protection violation at address %d (PC %d). Program halted.",
+			tm.faultaddr, tm.faultpc))
+	case cpuPAGE_FAULT:
+		tm.speak(fmt.Sprintf("Page fault at virtual address %d (PC %d). Program halted.",
+			tm.faultaddr, tm.faultpc))
+	case cpuPRIV_ERR:
+		tm.speak(fmt.Sprintf("Privileged instruction in user mode (PC %d). Program halted.",
+			tm.faultpc))
+	case cpuPORT_ERR:
+		tm.speak(fmt.Sprintf("Unconnected port %d (PC %d). Program halted.",
+			tm.faultaddr, tm.faultpc))
+	case cpuTAINT_ERR:
+		tm.speak(fmt.Sprintf("Tainted address %d (PC %d). Program halted.",
+			tm.faultaddr, tm.faultpc))
 	case cpuHALTED:
 		tm.speak("Program halted.")
 	}
@@ -327,19 +976,51 @@ func (tm *TinyMachine) runProgram() {
 		if tm.cpustate != cpuOK {
 			break
 		}
+		if tm.blocked {
+			// Nothing else can run to unblock the machine.
+			tm.speak(fmt.Sprintf("Blocked on %s port %d. Program stopped.", tm.blockedop, tm.blockedport))
+			break
+		}
+		if tm.stopAtBreakpoint() {
+			break
+		}
 	}
 }
 
-func (tm *TinyMachine) loadProgram(progname string, fh io.Reader) bool {
+// Report whether a program line has nothing to load, being blank or just
+// a comment.
+func isCommentLine(line string) bool {
+	r := regexp.MustCompile("[[:alnum:]]")
+	return !r.MatchString(withoutComment(line))
+}
+
+// Load a program, reporting every line that can't be loaded. The error
+// joins a *ParseError for each of them.
+func (tm *TinyMachine) loadProgram(progname string, fh io.Reader) error {
 	var (
-		i       int
-		linenum int = 0
+		i        int
+		linenum  int = 0
+		errs     []error
+		overflow bool
 	)
 
 	tm.initializeMachine(true)
 
 	reader := bufio.NewReader(fh)
 	tm.speak("Reading program from", progname)
+	tm.progname = progname
+
+	// Note the position of an error, blaming the whole line if the error
+	// doesn't say which part of it is wrong.
+	lineError := func(err error, line string) {
+		var perr *ParseError
+		if !errors.As(err, &perr) {
+			token := strings.TrimSpace(line)
+			perr = &ParseError{Column: strings.Index(line, token) + 1, Token: token, Msg: err.Error()}
+		}
+		perr.File, perr.Line = progname, linenum
+		errs = append(errs, perr)
+	}
 
 	for {
 		line, err := reader.ReadString('\n')
@@ -347,32 +1028,138 @@ func (tm *TinyMachine) loadProgram(progname string, fh io.Reader) bool {
 			if err == io.EOF {
 				break
 			} else {
-				tm.speak("Error reading program:", err)
-				return false
+				return err
 			}
 		} else {
 			linenum++
 			chomped_line := line[:len(line)-1] // Strip the
-			r := regexp.MustCompile("[[:alnum:]]")
-			has_content := r.MatchString(chomped_line)
 
-			if !has_content || strings.Index(chomped_line, "*") == 0 {
+			if isCommentLine(chomped_line) {
 				continue // Comments blank and comment lines
+			} else if strings.HasPrefix(strings.TrimSpace(chomped_line), ".") {
+				if err := tm.loadDirective(chomped_line); err != nil {
+					lineError(err, chomped_line)
+				}
 			} else {
 				instruction, err := parseInstruction(chomped_line)
 
 				if err != nil {
-					tm.speak(err)
-					tm.speak(fmt.Sprintf("Error parsing program at line %d: %s", linenum, chomped_line))
-					return false
+					// Leave room for it, so that the addresses of the
+					// instructions after it are right.
+					lineError(err, chomped_line)
+					i++
+				} else if i >= int(tm.mem_size) {
+					// Only the first instruction that doesn't fit is
+					// reported, but later lines are still checked.
+					if !overflow {
+						lineError(fmt.Errorf("Program doesn't fit in memory of %d words", tm.mem_size), chomped_line)
+						overflow = true
+					}
+					i++
+				} else if tm.unified {
+					word, err := instruction.encode()
+					if err != nil {
+						lineError(encodeError(chomped_line, instruction, err), chomped_line)
+					}
+					tm.image = append(tm.image, word)
+					tm.markInitialized(int32(i))
+					tm.data_memory[i], i = word, i+1
 				} else {
 					tm.instruction_memory[i], i = instruction, i+1
 				}
+				tm.srclines = append(tm.srclines, linenum)
 			}
 		}
 	}
 
-	return true
+	return errors.Join(errs...)
+}
+
+// Directives configure the machine rather than adding instructions. They
+// are of the form:
+//
+//	.protect start end ro|wo|none
+//	.priority n
+//	.data addr value...
+//
+// Errors are *ParseErrors, pointing at the field to blame.
+func (tm *TinyMachine) loadDirective(line string) error {
+	fields := lexFields(line)
+	all := tokenSpan(line, fields[0], fields[len(fields)-1])
+	invalid := parseError(all.column, all.text, "Invalid directive: '"+all.text+"'")
+
+	switch fields[0].text {
+	case ".priority":
+		if len(fields) != 2 {
+			return invalid
+		}
+
+		priority, err := strconv.ParseInt(fields[1].text, 10, 32)
+		if err != nil {
+			return parseError(fields[1].column, fields[1].text, "Invalid priority: '"+fields[1].text+"'")
+		}
+		tm.priority = int32(priority)
+		return nil
+	case ".protect":
+		if len(fields) != 4 {
+			return invalid
+		}
+
+		start, err := strconv.ParseInt(fields[1].text, 10, 32)
+		if err != nil {
+			return parseError(fields[1].column, fields[1].text, "Invalid start address: '"+fields[1].text+"'")
+		}
+		end, err := strconv.ParseInt(fields[2].text, 10, 32)
+		if err != nil {
+			return parseError(fields[2].column, fields[2].text, "Invalid end address: '"+fields[2].text+"'")
+		}
+
+		var prot MemProtection
+		switch fields[3].text {
+		case "ro":
+			prot = protReadOnly
+		case "wo":
+			prot = protWriteOnly
+		case "none":
+			prot = protNoAccess
+		default:
+			return parseError(fields[3].column, fields[3].text, "Invalid protection: '"+fields[3].text+"'")
+		}
+
+		if err := tm.Protect(int32(start), int32(end), prot); err != nil {
+			region := tokenSpan(line, fields[1], fields[2])
+			return parseError(region.column, region.text, err.Error())
+		}
+		return nil
+	case ".data":
+		if len(fields) < 3 {
+			return invalid
+		}
+
+		addr, err := strconv.ParseInt(fields[1].text, 10, 32)
+		if err != nil {
+			return parseError(fields[1].column, fields[1].text, "Invalid address: '"+fields[1].text+"'")
+		} else if addr < 0 || addr+int64(len(fields))-2 > int64(tm.mem_size) {
+			data := tokenSpan(line, fields[1], fields[len(fields)-1])
+			return parseError(data.column, data.text, "Data doesn't fit in memory: '"+all.text+"'")
+		}
+
+		if tm.initdata == nil {
+			tm.initdata = make(map[int32]int32)
+		}
+		for i, field := range fields[2:] {
+			v, err := strconv.ParseInt(field.text, 10, 32)
+			if err != nil {
+				return parseError(field.column, field.text, "Invalid value: '"+field.text+"'")
+			}
+			tm.initdata[int32(addr)+int32(i)] = int32(v)
+			tm.data_memory[int32(addr)+int32(i)] = int32(v)
+			tm.markInitialized(int32(addr) + int32(i))
+		}
+		return nil
+	default:
+		return parseError(fields[0].column, fields[0].text, "Invalid directive: '"+fields[0].text+"'")
+	}
 }
 
 func (tm *TinyMachine) dumpRegisters() {
@@ -390,7 +1177,7 @@ func (tm *TinyMachine) dumpRegisters() {
 }
 
 func (tm *TinyMachine) dumpMemory(start_addr, end_addr int32) {
-	tm.speak("Dumping data memory from address %d to %d", start_addr, end_addr)
+	tm.speak(fmt.Sprintf("Dumping data memory from address %d to %d", start_addr, end_addr))
 
 	for i := start_addr; i <= end_addr; i++ {
 		tm.speak(fmt.Sprintf("%04d: %d", i, tm.data_memory[i]))
@@ -398,21 +1185,26 @@ func (tm *TinyMachine) dumpMemory(start_addr, end_addr int32) {
 }
 
 func (tm *TinyMachine) dumpProgram(start_addr, end_addr int32) {
-	fmt.Printf("Dumping instruction memory from address %d to %d.\n", start_addr, end_addr)
+	fmt.Fprintf(tm.stdout, "Dumping instruction memory from address %d to %d.\n", start_addr, end_addr)
 
 	for i := start_addr; i <= end_addr; i++ {
-		fmt.Printf("%04d: %v\n", i, tm.instruction_memory[i])
+		if instruction, ok := tm.fetch(i); ok {
+			fmt.Fprintf(tm.stdout, "%04d: %v\n", i, instruction)
+		} else {
+			fmt.Fprintf(tm.stdout, "%04d: %-4s %d\n", i, "DATA", tm.data_memory[i])
+		}
 	}
 }
 
 func (tm *TinyMachine) readNumber(prompt string, def int32) int32 {
 	for {
-		fmt.Printf("%s: ", prompt)
+		fmt.Fprintf(tm.stdout, "%s: ", prompt)
 		input, err := tm.stdin.ReadString('\n')
 		if err != nil {
 			tm.speak("Error reading input. Returning default", def)
 			break
 		} else {
+			tm.recorder.add(input)
 			num, err := strconv.ParseInt(input[:len(input)-1], 10, 32)
 			if err != nil {
 				tm.speak("Error converting input. Returning default", def)
@@ -426,78 +1218,436 @@ func (tm *TinyMachine) readNumber(prompt string, def int32) int32 {
 	return def
 }
 
-func handleClear(tm *TinyMachine) {
-	tm.resetState()
+// Use the nth argument to a command as a number. If it was left out, prompt
+// for it, or use the default if there's no prompt.
+func (tm *TinyMachine) argNumber(args []string, n int, prompt string, def int32) (int32, error) {
+	if n >= len(args) {
+		if prompt == "" {
+			return def, nil
+		}
+		return tm.readNumber(prompt, def), nil
+	}
+
+	num, err := strconv.ParseInt(args[n], 10, 32)
+	if err != nil {
+		return 0, errors.New("Invalid number: '" + args[n] + "'")
+	}
+	return int32(num), nil
 }
 
-func handleDataMemoryDump(tm *TinyMachine) {
-	start_addr := tm.readNumber("Starting Address", 0)
-	end_addr := tm.readNumber("Ending Address", tm.mem_size-1)
-	if start_addr > end_addr || start_addr < 0 {
-		tm.speak("Invalid memory region")
+// Get the start and end of a memory region from a command's arguments.
+func (tm *TinyMachine) argRegion(args []string) (int32, int32, error) {
+	start_addr, err := tm.argNumber(args, 0, "Starting Address", 0)
+	if err != nil {
+		return 0, 0, err
+	}
+	end_addr, err := tm.argNumber(args, 1, "Ending Address", tm.mem_size-1)
+	if err != nil {
+		return 0, 0, err
 	}
 
-	if end_addr >= tm.mem_size {
-		tm.speak("Invalid memory region.")
+	if start_addr > end_addr || start_addr < 0 || end_addr >= tm.mem_size {
+		return 0, 0, errors.New("Invalid memory region.")
+	}
+	return start_addr, end_addr, nil
+}
+
+func handleClear(tm *TinyMachine, args []string) error {
+	if tm.sched != nil {
+		tm.sched.reset()
 	} else {
-		tm.dumpMemory(start_addr, end_addr)
+		tm.resetState()
 	}
+	return nil
 }
 
-func handleInstructionMemoryDump(tm *TinyMachine) {
-	start_addr := tm.readNumber("Starting Address", 0)
-	end_addr := tm.readNumber("Ending Address", tm.mem_size-1)
-	if start_addr > end_addr || start_addr < 0 {
-		tm.speak("Invalid memory region.")
+func handleDataMemoryDump(tm *TinyMachine, args []string) error {
+	start_addr, end_addr, err := tm.argRegion(args)
+	if err == nil {
+		tm.dumpMemory(start_addr, end_addr)
 	}
+	return err
+}
 
-	if end_addr >= tm.mem_size {
-		tm.speak("Invalid memory region.")
-	} else {
+func handleInstructionMemoryDump(tm *TinyMachine, args []string) error {
+	start_addr, end_addr, err := tm.argRegion(args)
+	if err == nil {
 		tm.dumpProgram(start_addr, end_addr)
 	}
+	return err
 }
 
-func handleGo(tm *TinyMachine) {
-	tm.runProgram()
+func handleGo(tm *TinyMachine, args []string) error {
+	if tm.sched != nil {
+		tm.sched.run()
+		tm.sched.listProcesses()
+	} else {
+		tm.runProgram()
+	}
+	return nil
 }
 
-func handleQuit(tm *TinyMachine) {
+func handleQuit(tm *TinyMachine, args []string) error {
 	tm.speak("Exiting.")
 	os.Exit(0)
+	return nil
 }
 
-func handleRegDump(tm *TinyMachine) {
+func handleRegDump(tm *TinyMachine, args []string) error {
 	tm.dumpRegisters()
+	return nil
+}
+
+// Step a number of instructions, one by default, stopping early if the
+// program can't go on.
+func handleStep(tm *TinyMachine, args []string) error {
+	count, err := tm.argNumber(args, 0, "", 1)
+	if err != nil {
+		return err
+	} else if count < 1 {
+		return errors.New("The number of steps must be at least 1.")
+	}
+
+	for i := int32(0); i < count; i++ {
+		if tm.sched == nil {
+			tm.stepProgram()
+			if tm.cpustate != cpuOK || tm.blocked || tm.stopAtBreakpoint() {
+				break
+			}
+		} else if !tm.sched.step() {
+			tm.speak("No process is able to run.")
+			break
+		} else if tm.sched.stopAtBreakpoint() {
+			break
+		}
+	}
+	return nil
+}
+
+func handleListProcesses(tm *TinyMachine, args []string) error {
+	tm.sched.listProcesses()
+	return nil
+}
+
+func handleInspectProcess(tm *TinyMachine, args []string) error {
+	pid, err := tm.argNumber(args, 0, "Process ID", int32(tm.sched.inspected))
+	if err != nil {
+		return err
+	} else if pid < 0 || int(pid) >= len(tm.sched.procs) {
+		return errors.New("Invalid process ID.")
+	}
+
+	tm.sched.inspected = int(pid)
+	tm.speak("Inspecting process", pid, tm.sched.procs[pid].name)
+	return nil
+}
+
+// Set a register, given by number or as pc.
+func handleSetRegister(tm *TinyMachine, args []string) error {
+	if len(args) != 2 {
+		return errors.New("Usage: setr r|pc value")
+	}
+
+	reg := int32(PC_REG)
+	if args[0] != "pc" {
+		n, err := strconv.ParseInt(args[0], 10, 32)
+		if err != nil || n < 0 || n >= NUM_REGS {
+			return errors.New("Invalid register: '" + args[0] + "'")
+		}
+		reg = int32(n)
+	}
+
+	v, err := tm.argNumber(args, 1, "", 0)
+	if err != nil {
+		return err
+	}
+
+	tm.registers[reg] = v
+	tm.noteRegisterWrite(reg, tm.registers[PC_REG], "edit")
+	return nil
+}
+
+// Write values to consecutive physical data memory addresses.
+func handleSetMemory(tm *TinyMachine, args []string) error {
+	if len(args) < 2 {
+		return errors.New("Usage: setm addr value...")
+	}
+
+	addr, err := tm.argNumber(args, 0, "", 0)
+	if err != nil {
+		return err
+	} else if addr < 0 || addr+int32(len(args))-1 > tm.mem_size {
+		return errors.New("Invalid memory region.")
+	}
+
+	values := make([]int32, len(args)-1)
+	for i := range values {
+		if values[i], err = tm.argNumber(args, i+1, "", 0); err != nil {
+			return err
+		}
+	}
+
+	copy(tm.data_memory[addr:], values)
+	for i := range values {
+		tm.noteMemoryWrite(addr+int32(i), tm.registers[PC_REG], "edit")
+	}
+	return nil
+}
+
+// Replace the instruction at an address. In unified mode, the encoded
+// instruction is also kept in the program image so that it survives
+// clearing the machine, as it would otherwise.
+func handleAssemble(tm *TinyMachine, args []string) error {
+	if len(args) < 2 {
+		return errors.New("Usage: asm addr instruction")
+	}
+
+	addr, err := tm.argNumber(args, 0, "", 0)
+	if err != nil {
+		return err
+	} else if addr < 0 || addr >= tm.mem_size {
+		return errors.New("Invalid address.")
+	}
+
+	instruction, err := parseInstruction(strings.Join(args[1:], " "))
+	if err != nil {
+		return err
+	}
+
+	if tm.unified {
+		word, err := instruction.encode()
+		if err != nil {
+			return err
+		}
+		for int32(len(tm.image)) <= addr {
+			tm.image = append(tm.image, 0)
+		}
+		tm.image[addr] = word
+		tm.data_memory[addr] = word
+		tm.noteMemoryWrite(addr, tm.registers[PC_REG], "edit")
+	} else {
+		tm.instruction_memory[addr] = instruction
+	}
+
+	tm.speak(fmt.Sprintf("%04d: %v", addr, instruction))
+	return nil
+}
+
+// List the breakpoints, or set one at an address, with an optional
+// condition following "if".
+func handleBreakpoint(tm *TinyMachine, args []string) error {
+	if len(args) == 0 {
+		tm.listBreakpoints()
+		return nil
+	}
+
+	addr, err := tm.argNumber(args, 0, "", 0)
+	if err != nil {
+		return err
+	} else if addr < 0 || addr >= tm.mem_size {
+		return errors.New("Invalid address.")
+	}
+
+	var cond *expr
+	condsrc := ""
+	if len(args) > 1 {
+		if args[1] != "if" || len(args) == 2 {
+			return errors.New("Usage: b [addr [if expr...]]")
+		}
+		condsrc = strings.Join(args[2:], " ")
+		if cond, err = parseExpr(condsrc); err != nil {
+			return err
+		}
+	}
+
+	bp := tm.setBreakpoint(addr)
+	bp.cond, bp.condsrc = cond, condsrc
+	return nil
+}
+
+func (tm *TinyMachine) listBreakpoints() {
+	if len(tm.breakpoints) == 0 {
+		tm.speak("No breakpoints.")
+		return
+	}
+
+	addrs := make([]int32, 0, len(tm.breakpoints))
+	for addr := range tm.breakpoints {
+		addrs = append(addrs, addr)
+	}
+	sort.Slice(addrs, func(i, j int) bool { return addrs[i] < addrs[j] })
+
+	for _, addr := range addrs {
+		bp := tm.breakpoints[addr]
+		cond := ""
+		if bp.cond != nil {
+			cond = " if " + bp.condsrc
+		}
+		tm.speak(fmt.Sprintf("%04d%s, hit %d times", addr, cond, bp.hits))
+	}
+}
+
+// Delete the breakpoint at an address, or all of them.
+func handleDeleteBreakpoint(tm *TinyMachine, args []string) error {
+	if len(args) == 0 {
+		tm.breakpoints = nil
+		return nil
+	}
+
+	addr, err := tm.argNumber(args, 0, "", 0)
+	if err != nil {
+		return err
+	} else if _, ok := tm.breakpoints[addr]; !ok {
+		return fmt.Errorf("No breakpoint at address %d.", addr)
+	}
+
+	delete(tm.breakpoints, addr)
+	return nil
 }
 
-func handleStep(tm *TinyMachine) {
-	tm.stepProgram()
+func handlePrint(tm *TinyMachine, args []string) error {
+	if len(args) == 0 {
+		return errors.New("Usage: print expr...")
+	}
+
+	src := strings.Join(args, " ")
+	e, err := parseExpr(src)
+	if err != nil {
+		return err
+	}
+	v, err := e.eval(exprEnv{tm: tm})
+	if err != nil {
+		return err
+	}
+
+	tm.speak(src, "=", v)
+	return nil
 }
 
-func handleTrace(tm *TinyMachine) {
+func handleTrace(tm *TinyMachine, args []string) error {
 	tm.trace = !tm.trace
 	tm.speak("Execution tracing is now", tm.trace)
+	return nil
 }
 
-func (tm *TinyMachine) Interact() {
+func (tm *TinyMachine) menu() map[string]menuAction {
 	menu := map[string]menuAction{
-		"?": menuAction{"display this help text", nil},
-		"c": menuAction{"clear machine state", handleClear},
-		"d": menuAction{"display data memory", handleDataMemoryDump},
-		"g": menuAction{"run program to halt state", handleGo},
-		"h": menuAction{"display this help text", nil},
-		"i": menuAction{"display instruction memory", handleInstructionMemoryDump},
-		"q": menuAction{"quit the tiny machine simulator", handleQuit},
-		"r": menuAction{"dump register contents", handleRegDump},
-		"s": menuAction{"step program forward by one instruction", handleStep},
-		"t": menuAction{"toggle execution tracing", handleTrace},
+		"?": menuAction{"", "display this help text", nil},
+		"c": menuAction{"", "clear machine state", handleClear},
+		"d": menuAction{"[start [end]]", "display data memory", handleDataMemoryDump},
+		"g": menuAction{"", "run program to halt state", handleGo},
+		"h": menuAction{"", "display this help text", nil},
+		"i": menuAction{"[start [end]]", "display instruction memory", handleInstructionMemoryDump},
+		"q": menuAction{"", "quit the tiny machine simulator", handleQuit},
+		"r": menuAction{"", "dump register contents", handleRegDump},
+		"s": menuAction{"[count]", "step program forward by count instructions, default 1", handleStep},
+		"t": menuAction{"", "toggle execution tracing", handleTrace},
+	}
+
+	menu["b"] = menuAction{"[addr [if expr...]]", "list breakpoints, or set one with an optional condition", handleBreakpoint}
+	menu["bd"] = menuAction{"[addr]", "delete the breakpoint at addr, or all breakpoints", handleDeleteBreakpoint}
+	menu["print"] = menuAction{"expr...", "evaluate an expression over registers, mem[addr] and steps", handlePrint}
+	menu["who"] = menuAction{"r|addr", "show what wrote a register, r0 to r7 or pc, or a memory cell", handleWho}
+	menu["taint"] = menuAction{"", "list the registers and memory cells holding values derived from input", handleTaint}
+	menu["asm"] = menuAction{"addr instruction...", "assemble an instruction, replacing the one at addr", handleAssemble}
+	menu["setm"] = menuAction{"addr value...", "write values to data memory from addr", handleSetMemory}
+	menu["setr"] = menuAction{"r|pc value", "set a register", handleSetRegister}
+	menu["record"] = menuAction{"[file]", "record commands to a file for replay, or stop recording", handleRecord}
+	menu["source"] = menuAction{"file", "run the commands in a file, stopping at any error", handleSource}
+
+	if tm.sched != nil {
+		menu["p"] = menuAction{"[pid]", "choose the process to inspect", handleInspectProcess}
+		menu["ps"] = menuAction{"", "list processes", handleListProcesses}
+	} else {
+		// These step a single machine, which would leave others behind.
+		menu["next"] = menuAction{"", "step one instruction, running any routine it calls until it returns", handleNext}
+		menu["until"] = menuAction{"addr", "run until the PC reaches addr", handleUntil}
+		menu["finish"] = menuAction{"", "run until the current routine returns", handleFinish}
+	}
+
+	return menu
+}
+
+// List the commands in order, with their descriptions lined up.
+func (tm *TinyMachine) help(menu map[string]menuAction) {
+	var keys []string
+	width := 0
+	for k, m := range menu {
+		keys = append(keys, k)
+		width = max(width, len(strings.TrimSpace(k+" "+m.args)))
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		usage := strings.TrimSpace(k + " " + menu[k].args)
+		fmt.Fprintf(tm.stdout, "%-*s  %s\n", width, usage, menu[k].desc)
+	}
+}
+
+// Run one line of input to the REPL. Commands are a key, optionally
+// followed by arguments separated by spaces.
+func (tm *TinyMachine) command(menu map[string]menuAction, line string) error {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return nil
+	}
+
+	menuitem, ok := menu[fields[0]]
+	if !ok {
+		return errors.New("Unknown command: '" + fields[0] + "'. Try 'h' for help.")
 	}
 
+	args := fields[1:]
+	maxargs := len(strings.Fields(strings.NewReplacer("[", "", "]", "").Replace(menuitem.args)))
+	if len(args) > maxargs && !strings.HasSuffix(strings.TrimRight(menuitem.args, "]"), "...") {
+		return errors.New("Too many arguments. Usage: " + fields[0] + " " + menuitem.args)
+	}
+
+	if menuitem.action == nil {
+		// Show the help text if the menu key has no action
+		tm.help(menu)
+		return nil
+	}
+
+	// With several processes, commands act on the one being inspected.
+	target := tm
+	if tm.sched != nil {
+		target = tm.sched.procs[tm.sched.inspected].tm
+	}
+	return menuitem.action(target, args)
+}
+
+// Run a line of input typed at the REPL, recording it if recording.
+func (tm *TinyMachine) enter(menu map[string]menuAction, input string) error {
+	r := tm.recorder
+	r.add(input)
+	err := tm.command(menu, input)
+	if tm.recorder == r {
+		// Commands that start or stop recording aren't recorded.
+		r.finish(err)
+	}
+
+	return err
+}
+
+func (tm *TinyMachine) Interact() {
+	menu := tm.menu()
+
 	tm.speak("Tiny Machine simulation (enter h for help)")
 
+	if *script_file != "" {
+		if err := tm.runScript(menu, *script_file); err != nil {
+			tm.speak(err)
+		}
+	}
+	if *record_file != "" {
+		if err := tm.record(*record_file); err != nil {
+			tm.speak(err)
+		}
+	}
+
 	for {
-		fmt.Printf("Enter command: ")
+		fmt.Fprintf(tm.stdout, "Enter command: ")
 		input, err := tm.stdin.ReadString('\n')
 		if err != nil {
 			if err == io.EOF {
@@ -511,19 +1661,8 @@ func (tm *TinyMachine) Interact() {
 			}
 		}
 
-		command := input[:len(input)-1]
-		if menuitem, ok := menu[command]; ok {
-			switch menuitem.action {
-			case nil:
-				// Show the help text if the menu key has no action
-				for k, m := range menu {
-					fmt.Printf("%s: %s\n", k, m.desc)
-				}
-			default:
-				menuitem.action(tm)
-			}
-		} else {
-			tm.speak("Not implemented yet. Try 'h' for help.")
+		if err := tm.enter(menu, input); err != nil {
+			tm.speak(err)
 		}
 	}
 }
@@ -532,20 +1671,71 @@ func main() {
 	var tm TinyMachine
 
 	flag.Parse()
+	tm.unified = *unified
+
+	if *taint_mode != "" && *taint_mode != "report" && *taint_mode != "fault" {
+		log.Fatal("Unknown taint mode: ", *taint_mode)
+	}
+
+	if *topology != "" {
+		runNetwork(*topology)
+		return
+	}
+
+	if *lsp {
+		if err := serveLSP(); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if *http_addr != "" {
+		if err := serveHTTP(*http_addr); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if *dap_addr != "" {
+		// The program is named by the editor when it launches a session.
+		if err := serveDAP(*dap_addr); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 
 	if len(flag.Args()) < 1 {
 		log.Fatal("You must supply a program as the first argument.")
 	}
 
+	if flag.Arg(0) == "inspect" {
+		if len(flag.Args()) != 2 {
+			log.Fatal("Usage: tinyvm inspect corefile")
+		}
+		if err := inspectCore(flag.Arg(1)); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if len(flag.Args()) > 1 || *cores > 1 {
+		runMultiprogrammed(flag.Args())
+		return
+	}
+
 	programfile, err := os.Open(flag.Args()[0])
 	if err != nil {
 		log.Fatalf("Error reading from %s: %s\n", flag.Args()[0], err)
 	}
 	defer programfile.Close()
 
-	if tm.loadProgram(flag.Args()[0], programfile) {
-		tm.Interact()
+	if err := tm.loadProgram(flag.Args()[0], programfile); err != nil {
+		log.Fatal(err)
+	} else if *gdb_addr != "" {
+		if err := serveGDB(&tm, *gdb_addr); err != nil {
+			log.Fatal(err)
+		}
 	} else {
-		log.Fatalf("Error loading program from:", flag.Args()[0])
+		tm.Interact()
 	}
 }
@@ -1,10 +1,13 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"errors"
 	"fmt"
 	"math"
 	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -25,6 +28,9 @@ func TestParseRMop(t *testing.T) {
 		{"", nil, "Invalid arguments: "},
 		{"10,1(1)", nil, "Invalid arguments. Bad register: 10"},
 		{"1,1(12)", nil, "Invalid arguments. Bad register: 12"},
+		{" 1, -2 (3) ", []int32{1, -2, 3}, ""},
+		{"1,2(3)4", nil, "Invalid arguments: 1,2(3)4"},
+		{"1,2,3", nil, "Invalid arguments: 1,2,3"},
 	}
 	for i, c := range cases {
 		got, got_err := parseRMop(c.in)
@@ -62,6 +68,9 @@ func TestParseROop(t *testing.T) {
 		{"12,1,1", nil, "Invalid arguments. Bad register: 12"},
 		{"2,13,1", nil, "Invalid arguments. Bad register: 13"},
 		{"2,1,14", nil, "Invalid arguments. Bad register: 14"},
+		{"2,\t1 , 0", []int32{2, 1, 0}, ""},
+		{"2 1 0", nil, "Invalid arguments: 2 1 0"},
+		{"2,-1,0", nil, "Invalid arguments. Bad register: -1"},
 	}
 	for i, c := range cases {
 		got, got_err := parseROop(c.in)
@@ -96,9 +105,17 @@ func TestParseInstruction(t *testing.T) {
 		{"SUB    0,0,0", TinyInstruction{"SUB", []int32{0, 0, 0}, iopRO}, ""},
 		{"MUL    0,0,0", TinyInstruction{"MUL", []int32{0, 0, 0}, iopRO}, ""},
 		{"DIV    0,0,0", TinyInstruction{"DIV", []int32{0, 0, 0}, iopRO}, ""},
+		{"CAS    0,0,0", TinyInstruction{"CAS", []int32{0, 0, 0}, iopRO}, ""},
+		{"CORE   0,0,0", TinyInstruction{"CORE", []int32{0, 0, 0}, iopRO}, ""},
+		{"RTT    0,0,0", TinyInstruction{"RTT", []int32{0, 0, 0}, iopRO}, ""},
+		{"STIM   0,0,0", TinyInstruction{"STIM", []int32{0, 0, 0}, iopRO}, ""},
+		{"EI     0,0,0", TinyInstruction{"EI", []int32{0, 0, 0}, iopRO}, ""},
+		{"DI     0,0,0", TinyInstruction{"DI", []int32{0, 0, 0}, iopRO}, ""},
+		{"RTI    0,0,0", TinyInstruction{"RTI", []int32{0, 0, 0}, iopRO}, ""},
 		// Valid RM instructions
 		{"LD     0,0(0)", TinyInstruction{"LD", []int32{0, 0, 0}, iopRM}, ""},
 		{"ST     0,0(0)", TinyInstruction{"ST", []int32{0, 0, 0}, iopRM}, ""},
+		{"FAA    0,0(0)", TinyInstruction{"FAA", []int32{0, 0, 0}, iopRM}, ""},
 		// Valid RA instructions
 		{"LDA    0,0(0)", TinyInstruction{"LDA", []int32{0, 0, 0}, iopRA}, ""},
 		{"LDC    0,0(0)", TinyInstruction{"LDC", []int32{0, 0, 0}, iopRA}, ""},
@@ -108,9 +125,28 @@ func TestParseInstruction(t *testing.T) {
 		{"JGE    0,0(0)", TinyInstruction{"JGE", []int32{0, 0, 0}, iopRA}, ""},
 		{"JEQ    0,0(0)", TinyInstruction{"JEQ", []int32{0, 0, 0}, iopRA}, ""},
 		{"JNE    0,0(0)", TinyInstruction{"JNE", []int32{0, 0, 0}, iopRA}, ""},
+		{"TVEC   0,0(0)", TinyInstruction{"TVEC", []int32{0, 0, 0}, iopRA}, ""},
+		{"IVEC   0,0(0)", TinyInstruction{"IVEC", []int32{0, 0, 0}, iopRA}, ""},
+		{"PTB    0,0(0)", TinyInstruction{"PTB", []int32{0, 0, 0}, iopRA}, ""},
+		{"USER   0,0(0)", TinyInstruction{"USER", []int32{0, 0, 0}, iopRA}, ""},
+		// Valid SYS instructions
+		{"SYS    0", TinyInstruction{"SYS", []int32{0, 0, 0}, iopSY}, ""},
+		{"SYS    12", TinyInstruction{"SYS", []int32{12, 0, 0}, iopSY}, ""},
 		// Garbage spaces are handled properly
 		{"   HALT  0,0,1   ", TinyInstruction{"HALT", []int32{0, 0, 1}, iopRO}, ""},
 		{"   LD  0,0(1)   ", TinyInstruction{"LD", []int32{0, 0, 1}, iopRM}, ""},
+		// Tabs and whitespace between operands
+		{"\tADD\t0, 1, 2", TinyInstruction{"ADD", []int32{0, 1, 2}, iopRO}, ""},
+		{"LD 0 , -3 ( 1 )", TinyInstruction{"LD", []int32{0, -3, 1}, iopRM}, ""},
+		{"SYS\t 4 ", TinyInstruction{"SYS", []int32{4, 0, 0}, iopSY}, ""},
+		// Mnemonics in any case
+		{"ldc 1,5(0)", TinyInstruction{"LDC", []int32{1, 5, 0}, iopRA}, ""},
+		{"Halt 0,0,0", TinyInstruction{"HALT", []int32{0, 0, 0}, iopRO}, ""},
+		// Trailing comments
+		{"OUT 1,0,0 ; print it", TinyInstruction{"OUT", []int32{1, 0, 0}, iopRO}, ""},
+		{"ST 1,2(3)* save", TinyInstruction{"ST", []int32{1, 2, 3}, iopRM}, ""},
+		{"ADD 1,2 ; 3", TinyInstruction{}, "Invalid arguments for opcode ADD: '1,2'"},
+		{"; ADD 1,2,3", TinyInstruction{}, "Invalid instruction: ''"},
 		// RM format for RO opcode
 		{"IN    0,0(1)", TinyInstruction{}, "Invalid arguments for opcode IN: '0,0(1)'"},
 		// RO format for RM opcode
@@ -126,6 +162,8 @@ func TestParseInstruction(t *testing.T) {
 		// Garbage inputs
 		{"IN 0,a,1   ", TinyInstruction{}, "Invalid arguments for opcode IN: '0,a,1'"},
 		{"ST 0,a(1)   ", TinyInstruction{}, "Invalid arguments for opcode ST: '0,a(1)'"},
+		{"SYS -1", TinyInstruction{}, "Invalid arguments for opcode SYS: '-1'"},
+		{"SYS 0,0,0", TinyInstruction{}, "Invalid arguments for opcode SYS: '0,0,0'"},
 	}
 	for _, c := range cases {
 		got, got_err := parseInstruction(c.in)
@@ -192,6 +230,16 @@ func TestLoadProgram(t *testing.T) {
 		// Invalid instruction
 		{"STORE 1,1(0)\nSUB 1,1,1\n",
 			false, []int{}, []TinyInstruction{}},
+		// Directives don't occupy instruction memory
+		{".protect 0 0 ro\nSUB 1,1,1\n",
+			true, []int{0}, []TinyInstruction{{"SUB", []int32{1, 1, 1}, iopRO}}},
+		// Invalid directives
+		{".protect 0 0 rw\nSUB 1,1,1\n",
+			false, []int{}, []TinyInstruction{}},
+		{".protect 10 0 ro\nSUB 1,1,1\n",
+			false, []int{}, []TinyInstruction{}},
+		{".unknown 1\nSUB 1,1,1\n",
+			false, []int{}, []TinyInstruction{}},
 		// Empty program
 		{"",
 			true, []int{0}, []TinyInstruction{{"HALT", []int32{0, 0, 0}, iopRO}}},
@@ -199,7 +247,7 @@ func TestLoadProgram(t *testing.T) {
 
 	for i, c := range cases {
 		program := bytes.NewBufferString(c.prog)
-		ok := tm.loadProgram(fmt.Sprintf("test-%d", i), program)
+		ok := tm.loadProgram(fmt.Sprintf("test-%d", i), program) == nil
 
 		if ok != c.valid {
 			t.Errorf("%d: Expected %t load, but didn't get it.", i, c.valid)
@@ -475,6 +523,79 @@ func TestSTInstruction(t *testing.T) {
 	}
 }
 
+func TestCASInstruction(t *testing.T) {
+	var tm TinyMachine
+
+	tm.initializeMachine(true)
+	// Stuff some values into the registers
+	tm.registers = [NUM_REGS]int32{5, 10, 7, 5, 8, DEF_MEM_SIZE, 0, 0}
+	tm.data_memory[10] = 5
+
+	tm.instruction_memory[0] = TinyInstruction{"CAS", []int32{0, 1, 2}, iopRO} // mem[10] == 5, swap in 7
+	tm.instruction_memory[1] = TinyInstruction{"CAS", []int32{3, 1, 4}, iopRO} // mem[10] != 5, no swap
+	tm.instruction_memory[2] = TinyInstruction{"CAS", []int32{3, 5, 4}, iopRO} // Bad address
+
+	cases := []struct {
+		expected_reg int32
+		expected_val int32
+		expected_mem int32
+		expected_cpu TinyCPUState
+	}{
+		{0, 1, 7, cpuOK},
+		{3, 0, 7, cpuOK},
+		{3, 0, 7, cpuDMEM_ERR},
+	}
+	for i, c := range cases {
+		tm.stepProgram()
+		if tm.registers[c.expected_reg] != c.expected_val || tm.data_memory[10] != c.expected_mem {
+			t.Errorf("%d: CAS instruction didn't work. Expected %d in reg[%d], %d in mem[10]. Got %d, %d.",
+				i, c.expected_val, c.expected_reg, c.expected_mem,
+				tm.registers[c.expected_reg], tm.data_memory[10])
+		}
+		if tm.cpustate != c.expected_cpu {
+			t.Errorf("%d: CAS instruction fine, but cpuState invalid. Wanted %d, got %d.",
+				i, c.expected_cpu, tm.cpustate)
+		}
+	}
+}
+
+func TestFAAInstruction(t *testing.T) {
+	var tm TinyMachine
+
+	tm.initializeMachine(true)
+	tm.Protect(20, 20, protWriteOnly)
+	// Stuff some values into the registers
+	tm.registers = [NUM_REGS]int32{3, 10, -5, 0, 0, 0, 0, 0}
+	tm.data_memory[10] = 100
+
+	tm.instruction_memory[0] = TinyInstruction{"FAA", []int32{0, 0, 1}, iopRM}  // mem[10] += 3
+	tm.instruction_memory[1] = TinyInstruction{"FAA", []int32{2, 0, 1}, iopRM}  // mem[10] += -5
+	tm.instruction_memory[2] = TinyInstruction{"FAA", []int32{2, 10, 1}, iopRM} // Can't read mem[20]
+
+	cases := []struct {
+		expected_reg int32
+		expected_val int32
+		expected_mem int32
+		expected_cpu TinyCPUState
+	}{
+		{0, 100, 103, cpuOK},
+		{2, 103, 98, cpuOK},
+		{2, 103, 98, cpuPROT_ERR},
+	}
+	for i, c := range cases {
+		tm.stepProgram()
+		if tm.registers[c.expected_reg] != c.expected_val || tm.data_memory[10] != c.expected_mem {
+			t.Errorf("%d: FAA instruction didn't work. Expected %d in reg[%d], %d in mem[10]. Got %d, %d.",
+				i, c.expected_val, c.expected_reg, c.expected_mem,
+				tm.registers[c.expected_reg], tm.data_memory[10])
+		}
+		if tm.cpustate != c.expected_cpu {
+			t.Errorf("%d: FAA instruction fine, but cpuState invalid. Wanted %d, got %d.",
+				i, c.expected_cpu, tm.cpustate)
+		}
+	}
+}
+
 func TestLDCInstruction(t *testing.T) {
 	var tm TinyMachine
 
@@ -737,6 +858,357 @@ func TestJNEInstruction(t *testing.T) {
 	}
 }
 
+func TestSYSInstruction(t *testing.T) {
+	var tm TinyMachine
+
+	tm.initializeMachine(true)
+	// Stuff some values into the registers
+	tm.registers = [NUM_REGS]int32{2, 3, 0, 0, 0, 0, 0, 0}
+
+	tm.RegisterSyscall(1, func(tm *TinyMachine) error {
+		tm.registers[0] = tm.registers[0] + tm.registers[1]
+		return tm.WriteMemory(1, tm.registers[0])
+	})
+	tm.RegisterSyscall(2, func(tm *TinyMachine) error {
+		return errors.New("fixture not found")
+	})
+
+	tm.instruction_memory[0] = TinyInstruction{"SYS", []int32{1, 0, 0}, iopSY} // 2 + 3 -> reg0, mem[1]
+	tm.instruction_memory[1] = TinyInstruction{"SYS", []int32{3, 0, 0}, iopSY} // Unregistered
+	tm.instruction_memory[2] = TinyInstruction{"SYS", []int32{2, 0, 0}, iopSY} // Handler fails
+
+	tm.stepProgram()
+	if tm.registers[0] != 5 || tm.data_memory[1] != 5 {
+		t.Errorf("SYS handler didn't run. Got reg[0] = %d, mem[1] = %d.",
+			tm.registers[0], tm.data_memory[1])
+	}
+	if tm.cpustate != cpuOK {
+		t.Errorf("SYS instruction fine, but cpuState invalid. Wanted %d, got %d.",
+			cpuOK, tm.cpustate)
+	}
+
+	for _, pc := range []int32{1, 2} {
+		tm.resetState()
+		tm.registers[PC_REG] = pc
+		tm.stepProgram()
+		if tm.cpustate != cpuSYS_ERR {
+			t.Errorf("%d: Expected cpu state to be %d. Got %d.", pc, cpuSYS_ERR, tm.cpustate)
+		}
+		if tm.syserr == nil {
+			t.Errorf("%d: Expected SYS error to be recorded.", pc)
+		}
+	}
+}
+
+func TestTrapHandler(t *testing.T) {
+	var tm TinyMachine
+
+	tm.initializeMachine(true)
+	// Stuff some values into the registers
+	tm.registers = [NUM_REGS]int32{0, 100, 10, 0, 0, 0, 0, 0}
+
+	tm.instruction_memory[0] = TinyInstruction{"TVEC", []int32{1, 20, 0}, iopRA} // Handler at 20, frame at 100
+	tm.instruction_memory[1] = TinyInstruction{"DIV", []int32{3, 2, 0}, iopRO}   // 10 / 0 -> trap
+	tm.instruction_memory[2] = TinyInstruction{"LD", []int32{3, -5, 0}, iopRM}   // Bad address -> trap
+	tm.instruction_memory[20] = TinyInstruction{"RTT", []int32{0, 0, 0}, iopRO}  // Return to faulting PC
+
+	cases := []struct {
+		expected_pc    int32        // Expected PC value
+		expected_cpu   TinyCPUState // Expected CPU state
+		expected_frame []int32      // Expected trap frame contents
+	}{
+		{1, cpuOK, []int32{0, 0, 0}},
+		{20, cpuOK, []int32{1, int32(cpuDIV_ZERO), 1}},
+		{1, cpuOK, []int32{1, int32(cpuDIV_ZERO), 1}},
+	}
+	for i, c := range cases {
+		tm.stepProgram()
+		if tm.registers[PC_REG] != c.expected_pc {
+			t.Errorf("%d: Expected PC to be %d. Got %d.", i, c.expected_pc, tm.registers[PC_REG])
+		}
+		if tm.cpustate != c.expected_cpu {
+			t.Errorf("%d: Expected cpu state to be %d. Got %d.", i, c.expected_cpu, tm.cpustate)
+		}
+		if frame := tm.data_memory[100:103]; !reflect.DeepEqual(frame, c.expected_frame) {
+			t.Errorf("%d: Expected trap frame %v. Got %v.", i, c.expected_frame, frame)
+		}
+	}
+
+	// Skip the DIV and fault on the LD instead.
+	tm.registers[PC_REG] = 2
+	tm.stepProgram()
+	if frame := tm.data_memory[100:103]; !reflect.DeepEqual(frame, []int32{2, int32(cpuDMEM_ERR), -5}) {
+		t.Errorf("Expected DMEM_ERR in trap frame. Got %v.", frame)
+	}
+
+	// A fault inside the handler halts the machine.
+	tm.instruction_memory[20] = TinyInstruction{"DIV", []int32{3, 2, 0}, iopRO}
+	tm.stepProgram()
+	if tm.cpustate != cpuDIV_ZERO {
+		t.Errorf("Expected double fault to halt with state %d. Got %d.", cpuDIV_ZERO, tm.cpustate)
+	}
+
+	// Uninstalling the handler restores the default behavior.
+	tm.resetState()
+	tm.registers = [NUM_REGS]int32{0, 100, 10, 0, 0, 0, 0, 0}
+	tm.instruction_memory[0] = TinyInstruction{"TVEC", []int32{1, -1, 0}, iopRA}
+	tm.stepProgram()
+	tm.stepProgram()
+	if tm.cpustate != cpuDIV_ZERO || tm.registers[PC_REG] != 2 {
+		t.Errorf("Expected fault to halt without a handler. Got state %d, PC %d.",
+			tm.cpustate, tm.registers[PC_REG])
+	}
+}
+
+func TestTimerInterrupt(t *testing.T) {
+	var tm TinyMachine
+
+	tm.initializeMachine(true)
+	// Stuff some values into the registers
+	tm.registers = [NUM_REGS]int32{0, 100, 2, 0, 0, 0, 0, 0}
+
+	tm.instruction_memory[0] = TinyInstruction{"IVEC", []int32{1, 20, 0}, iopRA} // Handler at 20, frame at 100
+	tm.instruction_memory[1] = TinyInstruction{"STIM", []int32{2, 0, 0}, iopRO}  // Every 2 instructions
+	tm.instruction_memory[2] = TinyInstruction{"DI", []int32{0, 0, 0}, iopRO}
+	tm.instruction_memory[3] = TinyInstruction{"LDA", []int32{3, 1, 3}, iopRA}
+	tm.instruction_memory[4] = TinyInstruction{"EI", []int32{0, 0, 0}, iopRO} // Pending interrupt delivered
+	tm.instruction_memory[20] = TinyInstruction{"LDA", []int32{4, 1, 4}, iopRA}
+	tm.instruction_memory[21] = TinyInstruction{"RTI", []int32{0, 0, 0}, iopRO}
+
+	cases := []struct {
+		expected_pc    int32 // Expected PC value
+		expected_saved int32 // Expected PC in the interrupt frame
+		expected_int   bool  // Expected interrupt enable state
+	}{
+		{1, 0, false},
+		{2, 0, false},
+		{3, 0, false},
+		{4, 0, false}, // Timer expired, but interrupts are disabled
+		{20, 5, false},
+		{21, 5, false}, // Timer expired in the handler
+		{20, 5, false}, // Delivered as soon as RTI re-enables interrupts
+	}
+	for i, c := range cases {
+		tm.stepProgram()
+		if tm.registers[PC_REG] != c.expected_pc {
+			t.Errorf("%d: Expected PC to be %d. Got %d.", i, c.expected_pc, tm.registers[PC_REG])
+		}
+		if tm.data_memory[100] != c.expected_saved {
+			t.Errorf("%d: Expected saved PC to be %d. Got %d.", i, c.expected_saved, tm.data_memory[100])
+		}
+		if tm.intenabled != c.expected_int {
+			t.Errorf("%d: Expected interrupts enabled to be %t. Got %t.", i, c.expected_int, tm.intenabled)
+		}
+		if tm.cpustate != cpuOK {
+			t.Errorf("%d: Expected cpu state to be %d. Got %d.", i, cpuOK, tm.cpustate)
+		}
+	}
+}
+
+func TestUnifiedMemory(t *testing.T) {
+	var tm TinyMachine
+
+	tm.unified = true
+	prog := "LD 1,3(0)\nLDA 1,42(1)\nST 1,3(0)\nLDC 2,0(0)\n"
+	if err := tm.loadProgram("unified", bytes.NewBufferString(prog)); err != nil {
+		t.Fatalf("Couldn't load program in unified mode.")
+	}
+
+	// Running twice checks that resetting restores the original program.
+	for run := 0; run < 2; run++ {
+		tm.resetState()
+		for i := 0; i < 4; i++ {
+			tm.stepProgram()
+		}
+		if tm.registers[2] != 42 {
+			t.Errorf("%d: Self-modified LDC didn't run. Expected 42 in reg[2]. Got %d.",
+				run, tm.registers[2])
+		}
+
+		// Jump to a word that doesn't hold a valid instruction.
+		tm.data_memory[6] = -1
+		tm.registers[PC_REG] = 6
+		tm.stepProgram()
+		if tm.cpustate != cpuDECODE_ERR {
+			t.Errorf("%d: Expected cpu state to be %d. Got %d.", run, cpuDECODE_ERR, tm.cpustate)
+		}
+		if tm.registers[PC_REG] != 6 {
+			t.Errorf("%d: Expected PC to stay at 6. Got %d.", run, tm.registers[PC_REG])
+		}
+	}
+
+	// Constants that can't be encoded are rejected at load time.
+	if tm.loadProgram("too-big", bytes.NewBufferString("LDC 1,600000(0)\n")) == nil {
+		t.Errorf("Expected load of unencodable instruction to fail.")
+	}
+}
+
+func TestPROT_ERR_State(t *testing.T) {
+	var tm TinyMachine
+
+	tm.initializeMachine(true)
+	tm.Protect(0, 0, protReadOnly)
+	tm.Protect(10, 19, protWriteOnly)
+	tm.Protect(15, 15, protNoAccess) // Overrides the write-only region
+
+	cases := []struct {
+		given_inst   TinyInstruction // The instruction to execute
+		expected_cpu TinyCPUState    // Expected CPU state
+	}{
+		{TinyInstruction{"LD", []int32{0, 0, 1}, iopRM}, cpuOK},
+		{TinyInstruction{"ST", []int32{0, 0, 1}, iopRM}, cpuPROT_ERR},
+		{TinyInstruction{"ST", []int32{0, 1, 1}, iopRM}, cpuOK},
+		{TinyInstruction{"LD", []int32{0, 10, 1}, iopRM}, cpuPROT_ERR},
+		{TinyInstruction{"ST", []int32{0, 19, 1}, iopRM}, cpuOK},
+		{TinyInstruction{"LD", []int32{0, 15, 1}, iopRM}, cpuPROT_ERR},
+		{TinyInstruction{"ST", []int32{0, 15, 1}, iopRM}, cpuPROT_ERR},
+	}
+	for i, c := range cases {
+		tm.registers = [NUM_REGS]int32{0, 0, 0, 0, 0, 0, 0, 3}
+		tm.instruction_memory[3] = c.given_inst
+
+		tm.stepProgram()
+
+		if tm.cpustate != c.expected_cpu {
+			t.Errorf("%d: Expected cpu state to be %d. Got %d.", i, c.expected_cpu, tm.cpustate)
+		}
+		if c.expected_cpu == cpuPROT_ERR && (tm.faultpc != 3 || tm.faultaddr != c.given_inst.iargs[1]) {
+			t.Errorf("%d: Expected fault at PC 3, address %d. Got PC %d, address %d.",
+				i, c.given_inst.iargs[1], tm.faultpc, tm.faultaddr)
+		}
+		tm.resetState()
+	}
+
+	if err := tm.Protect(0, DEF_MEM_SIZE, protReadOnly); err == nil {
+		t.Errorf("Expected error protecting a region beyond the end of memory.")
+	}
+}
+
+func TestPagedMemory(t *testing.T) {
+	var tm TinyMachine
+
+	tm.initializeMachine(true)
+
+	cases := []struct {
+		given_inst    TinyInstruction // The instruction to execute after enabling paging
+		expected_cpu  TinyCPUState    // Expected CPU state
+		expected_addr int32           // Expected fault address
+	}{
+		{TinyInstruction{"LD", []int32{2, 17, 0}, iopRM}, cpuOK, 0},          // Page 1 -> frame 5
+		{TinyInstruction{"ST", []int32{2, 50, 0}, iopRM}, cpuOK, 0},          // Page 3 -> frame 6
+		{TinyInstruction{"ST", []int32{2, 20, 0}, iopRM}, cpuPAGE_FAULT, 20}, // Page 1 is read-only
+		{TinyInstruction{"LD", []int32{2, 40, 0}, iopRM}, cpuPAGE_FAULT, 40}, // Page 2 is invalid
+		{TinyInstruction{"LD", []int32{2, 70, 0}, iopRM}, cpuPAGE_FAULT, 70}, // Past the page table
+		{TinyInstruction{"LD", []int32{2, -1, 0}, iopRM}, cpuPAGE_FAULT, -1},
+		{TinyInstruction{"LDA", []int32{7, 32, 0}, iopRA}, cpuPAGE_FAULT, 32}, // Fetch from page 2
+	}
+	for i, c := range cases {
+		// Stuff some values into the registers and memory
+		tm.registers = [NUM_REGS]int32{0, 4, 0, 0, 0, 0, 0, 0}
+		tm.data_memory[200] = 0<<PTE_FRAME_SHIFT | PTE_VALID | PTE_WRITE
+		tm.data_memory[201] = 5<<PTE_FRAME_SHIFT | PTE_VALID
+		tm.data_memory[202] = 0
+		tm.data_memory[203] = 6<<PTE_FRAME_SHIFT | PTE_VALID | PTE_WRITE
+		tm.data_memory[81] = 777
+		tm.instruction_memory[0] = TinyInstruction{"PTB", []int32{1, 200, 0}, iopRA}
+		tm.instruction_memory[1] = c.given_inst
+
+		tm.stepProgram()
+		tm.stepProgram()
+		if c.given_inst.iop == "LDA" {
+			tm.stepProgram() // Fetch from the jump target
+		}
+
+		if tm.cpustate != c.expected_cpu {
+			t.Errorf("%d: Expected cpu state to be %d. Got %d.", i, c.expected_cpu, tm.cpustate)
+		} else if c.expected_cpu == cpuPAGE_FAULT && tm.faultaddr != c.expected_addr {
+			t.Errorf("%d: Expected fault address %d. Got %d.", i, c.expected_addr, tm.faultaddr)
+		}
+		tm.resetState()
+	}
+
+	// Check the successful accesses went to the mapped frames.
+	tm.registers = [NUM_REGS]int32{0, 4, 0, 0, 0, 0, 0, 0}
+	tm.data_memory[200] = 0<<PTE_FRAME_SHIFT | PTE_VALID | PTE_WRITE
+	tm.data_memory[201] = 5<<PTE_FRAME_SHIFT | PTE_VALID
+	tm.data_memory[203] = 6<<PTE_FRAME_SHIFT | PTE_VALID | PTE_WRITE
+	tm.data_memory[81] = 777
+	tm.instruction_memory[1] = cases[0].given_inst
+	tm.instruction_memory[2] = cases[1].given_inst
+	for i := 0; i < 3; i++ {
+		tm.stepProgram()
+	}
+	if tm.registers[2] != 777 || tm.data_memory[98] != 777 {
+		t.Errorf("Paged LD/ST didn't work. Got reg[2] = %d, mem[98] = %d.",
+			tm.registers[2], tm.data_memory[98])
+	}
+}
+
+func TestPrivilegeModes(t *testing.T) {
+	var tm TinyMachine
+
+	tm.initializeMachine(true)
+	// Stuff some values into the registers
+	tm.registers = [NUM_REGS]int32{0, 100, 0, 0, 0, 0, 0, 0}
+
+	tm.instruction_memory[0] = TinyInstruction{"TVEC", []int32{1, 20, 0}, iopRA} // Handler at 20, frame at 100
+	tm.instruction_memory[1] = TinyInstruction{"USER", []int32{0, 10, 0}, iopRA}
+	tm.instruction_memory[10] = TinyInstruction{"ADD", []int32{2, 2, 1}, iopRO}
+	tm.instruction_memory[11] = TinyInstruction{"OUT", []int32{2, 0, 0}, iopRO} // Privileged
+	tm.instruction_memory[20] = TinyInstruction{"RTT", []int32{0, 0, 0}, iopRO}
+
+	cases := []struct {
+		expected_pc   int32 // Expected PC value
+		expected_user bool  // Expected user mode
+	}{
+		{1, false},
+		{10, true},
+		{11, true},
+		{20, false}, // OUT trapped into the supervisor
+		{11, true},  // RTT restored user mode
+	}
+	for i, c := range cases {
+		tm.stepProgram()
+		if tm.registers[PC_REG] != c.expected_pc {
+			t.Errorf("%d: Expected PC to be %d. Got %d.", i, c.expected_pc, tm.registers[PC_REG])
+		}
+		if tm.usermode != c.expected_user {
+			t.Errorf("%d: Expected user mode to be %t. Got %t.", i, c.expected_user, tm.usermode)
+		}
+		if tm.cpustate != cpuOK {
+			t.Errorf("%d: Expected cpu state to be %d. Got %d.", i, cpuOK, tm.cpustate)
+		}
+	}
+	if tm.data_memory[100+TRAP_FRAME_CAUSE] != int32(cpuPRIV_ERR) {
+		t.Errorf("Expected trap cause %d. Got %d.", cpuPRIV_ERR, tm.data_memory[100+TRAP_FRAME_CAUSE])
+	}
+
+	// SYS isn't privileged, so user code can call the host directly.
+	tm.resetState()
+	tm.RegisterSyscall(1, func(tm *TinyMachine) error {
+		tm.registers[3] = 42
+		return nil
+	})
+	tm.instruction_memory[10] = TinyInstruction{"SYS", []int32{1, 0, 0}, iopSY}
+	tm.stepProgram()
+	tm.stepProgram()
+	tm.stepProgram()
+	if tm.cpustate != cpuOK || !tm.usermode || tm.registers[3] != 42 || tm.registers[PC_REG] != 11 {
+		t.Errorf("Expected SYS to run in user mode. Got state %d, user mode %t, r3 = %d at PC %d.",
+			tm.cpustate, tm.usermode, tm.registers[3], tm.registers[PC_REG])
+	}
+
+	// Without a handler, a privileged instruction in user mode halts.
+	tm.resetState()
+	tm.instruction_memory[0] = TinyInstruction{"USER", []int32{0, 10, 0}, iopRA}
+	tm.instruction_memory[10] = TinyInstruction{"HALT", []int32{0, 0, 0}, iopRO}
+	tm.stepProgram()
+	tm.stepProgram()
+	if tm.cpustate != cpuPRIV_ERR || tm.faultpc != 10 {
+		t.Errorf("Expected privilege fault at PC 10. Got state %d at PC %d.", tm.cpustate, tm.faultpc)
+	}
+}
+
 func TestDMEM_ERR_State(t *testing.T) {
 	var tm TinyMachine
 
@@ -794,3 +1266,205 @@ func TestIMEM_ERR_State(t *testing.T) {
 		tm.resetState() // Reset so the next test instruction has a clean start
 	}
 }
+
+func TestCommand(t *testing.T) {
+	prog := "LDA 1,1(1)\nLDA 1,1(1)\nLDA 1,1(1)\nHALT 0,0,0\n"
+
+	cases := []struct {
+		line     string
+		input    string // Answers to prompts
+		want_out string
+		want_err string
+		want_pc  int32
+	}{
+		{"", "", "", "", 0},
+		{"s", "", "", "", 1},
+		{"s 2", "", "", "", 2},
+		{"s 10", "", "Program halted.\n", "", 4},
+		{"  s   0 ", "", "", "The number of steps must be at least 1.", 0},
+		{"s x", "", "", "Invalid number: 'x'", 0},
+		{"s 1 2", "", "", "Too many arguments. Usage: s [count]", 0},
+		{"x", "", "", "Unknown command: 'x'. Try 'h' for help.", 0},
+		{"d 1 2", "", "Dumping data memory from address 1 to 2\n0001: 0\n0002: 7\n", "", 0},
+		{"d 1", "2\n", "Ending Address: Dumping data memory from address 1 to 2\n0001: 0\n0002: 7\n", "", 0},
+		{"d", "1\n2\n", "Starting Address: Ending Address: Dumping data memory from address 1 to 2\n0001: 0\n0002: 7\n", "", 0},
+		{"d 2 1", "", "", "Invalid memory region.", 0},
+		{"d -1 1", "", "", "Invalid memory region.", 0},
+		{"i 0 2", "", "Dumping instruction memory from address 0 to 2.\n0000: LDA  1,1(1)\n0001: LDA  1,1(1)\n0002: LDA  1,1(1)\n", "", 0},
+		{"i 0 5000", "", "", "Invalid memory region.", 0},
+	}
+
+	for i, c := range cases {
+		var tm TinyMachine
+		var out bytes.Buffer
+		if err := tm.loadProgram("test", bytes.NewBufferString(prog)); err != nil {
+			t.Fatalf("%d: Unexpected error loading program.", i)
+		}
+		tm.data_memory[2] = 7
+		tm.stdout = &out
+		tm.stdin = bufio.NewReader(bytes.NewBufferString(c.input))
+
+		err := tm.command(tm.menu(), c.line)
+		if c.want_err == "" && err != nil {
+			t.Errorf("%d: Unexpected error: %s", i, err)
+		} else if c.want_err != "" && (err == nil || err.Error() != c.want_err) {
+			t.Errorf("%d: Expected error %q. Got %v.", i, c.want_err, err)
+		}
+		if out.String() != c.want_out {
+			t.Errorf("%d: Expected output %q. Got %q.", i, c.want_out, out.String())
+		}
+		if tm.registers[PC_REG] != c.want_pc {
+			t.Errorf("%d: Expected PC %d. Got %d.", i, c.want_pc, tm.registers[PC_REG])
+		}
+	}
+}
+
+func TestHelp(t *testing.T) {
+	var tm TinyMachine
+	var out bytes.Buffer
+
+	tm.stdout = &out
+	tm.help(map[string]menuAction{
+		"s":  menuAction{"[count]", "step", handleStep},
+		"?":  menuAction{"", "help", nil},
+		"ps": menuAction{"", "list processes", handleListProcesses},
+	})
+
+	want := "?          help\nps         list processes\ns [count]  step\n"
+	if out.String() != want {
+		t.Errorf("Expected help %q. Got %q.", want, out.String())
+	}
+}
+
+func TestEditCommands(t *testing.T) {
+	for _, unified := range []bool{false, true} {
+		var tm TinyMachine
+		var out bytes.Buffer
+
+		tm.unified = unified
+		if err := tm.loadProgram("test", bytes.NewBufferString("LDC 1,1(0)\nST 1,20(0)\nHALT 0,0,0\n")); err != nil {
+			t.Fatalf("Unexpected error loading program.")
+		}
+		tm.stdout = &out
+		menu := tm.menu()
+
+		lines := []string{"setr 1 5", "setr pc 1", "setm 20 7 8", "asm 1 ST 1,21(0)", "s 2"}
+		for _, line := range lines {
+			if err := tm.command(menu, line); err != nil {
+				t.Errorf("%t: Unexpected error from %q: %s", unified, line, err)
+			}
+		}
+		if tm.data_memory[20] != 7 || tm.data_memory[21] != 5 || tm.cpustate != cpuHALTED {
+			t.Errorf("%t: Expected edits to take effect. Got %v in state %d.",
+				unified, tm.data_memory[20:22], tm.cpustate)
+		}
+		if !strings.Contains(out.String(), "0001: ST   1,21(0)") {
+			t.Errorf("%t: Expected the new instruction to be shown. Got %q.", unified, out.String())
+		}
+
+		// Assembled instructions survive clearing the machine.
+		tm.command(menu, "c")
+		tm.command(menu, "g")
+		if tm.data_memory[21] != 1 {
+			t.Errorf("%t: Expected the new instruction after clearing. Got %d.", unified, tm.data_memory[21])
+		}
+	}
+
+	cases := []struct {
+		line     string
+		want_err string
+	}{
+		{"setr 8 1", "Invalid register: '8'"},
+		{"setr x 1", "Invalid register: 'x'"},
+		{"setr 1", "Usage: setr r|pc value"},
+		{"setr 1 x", "Invalid number: 'x'"},
+		{"setm 1", "Usage: setm addr value..."},
+		{"setm 1023 1 2", "Invalid memory region."},
+		{"setm -1 1", "Invalid memory region."},
+		{"asm 1024 HALT 0,0,0", "Invalid address."},
+		{"asm 1 JMP 0,0,0", "Invalid opcode: 'JMP'"},
+		{"asm 1", "Usage: asm addr instruction"},
+	}
+	for i, c := range cases {
+		var tm TinyMachine
+		tm.stdout = &bytes.Buffer{}
+		tm.initializeMachine(true)
+
+		err := tm.command(tm.menu(), c.line)
+		if err == nil || err.Error() != c.want_err {
+			t.Errorf("%d: Expected error %q. Got %v.", i, c.want_err, err)
+		}
+	}
+}
+
+func TestBreakpoints(t *testing.T) {
+	var tm TinyMachine
+	var out bytes.Buffer
+
+	// Count r1 up to 10.
+	prog := "LDA 1,1(1)\nLDC 2,10(0)\nSUB 2,2,1\nJGT 2,-4(7)\nHALT 0,0,0\n"
+	if err := tm.loadProgram("test", bytes.NewBufferString(prog)); err != nil {
+		t.Fatalf("Unexpected error loading program.")
+	}
+	tm.stdout = &out
+	menu := tm.menu()
+
+	cases := []struct {
+		line  string
+		r1    int32
+		state TinyCPUState
+	}{
+		{"b 2 if r1 == 3", 0, cpuOK},
+		{"g", 3, cpuOK},
+		{"bd 2", 3, cpuOK},
+		{"b 1 if hits == 3", 3, cpuOK},
+		{"s 100", 6, cpuOK},
+		{"bd", 6, cpuOK},
+		{"g", 10, cpuHALTED},
+	}
+	for i, c := range cases {
+		if err := tm.command(menu, c.line); err != nil {
+			t.Errorf("%d: Unexpected error from %q: %s", i, c.line, err)
+		}
+		if tm.registers[1] != c.r1 || tm.cpustate != c.state {
+			t.Errorf("%d: Expected r1 %d in state %d after %q. Got %d in state %d.",
+				i, c.r1, c.state, c.line, tm.registers[1], tm.cpustate)
+		}
+	}
+
+	tm.command(menu, "c")
+	tm.command(menu, "b 3 if mem[r2] > 0 && r1 < 5")
+	tm.command(menu, "b 0")
+	out.Reset()
+	tm.command(menu, "b")
+	want := "0000, hit 0 times\n0003 if mem[r2] > 0 && r1 < 5, hit 0 times\n"
+	if out.String() != want {
+		t.Errorf("Expected breakpoints to be listed. Got %q.", out.String())
+	}
+
+	out.Reset()
+	tm.command(menu, "g")
+	tm.command(menu, "print r1 * 2 + steps")
+	if !strings.Contains(out.String(), "Breakpoint at PC 0, hit 1 times.") || !strings.HasSuffix(out.String(), "r1 * 2 + steps = 6\n") {
+		t.Errorf("Expected to stop at PC 0 and print 6. Got %q.", out.String())
+	}
+
+	errs := []struct {
+		line     string
+		want_err string
+	}{
+		{"b 1024", "Invalid address."},
+		{"b 1 when r1", "Usage: b [addr [if expr...]]"},
+		{"b 1 if", "Usage: b [addr [if expr...]]"},
+		{"b 1 if r1 +", "Unexpected end of expression"},
+		{"bd 7", "No breakpoint at address 7."},
+		{"print", "Usage: print expr..."},
+		{"print hits / 0", "Division by zero in expression"},
+	}
+	for i, c := range errs {
+		err := tm.command(menu, c.line)
+		if err == nil || err.Error() != c.want_err {
+			t.Errorf("%d: Expected error %q. Got %v.", i, c.want_err, err)
+		}
+	}
+}